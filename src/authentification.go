@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+/*-------------------------------------------------------------- */
+/*--------------------AUTHENTIFICATION DES CLIENTS-------------- */
+/*-------------------------------------------------------------- */
+
+/* Si le serveur est lancé avec un fichier d'identités (-identites), chaque
+client doit s'authentifier pendant le handshake :
+	SYN ... id=<identité>
+	SYN-ACK<port> ... defi=<16 octets aléatoires en hex>
+	ACK preuve=<hex>
+La preuve porte sur "TCP_over_UDP <identité> <defi>" : c'est un HMAC-SHA256
+avec le secret partagé de l'identité, ou une signature Ed25519 vérifiée avec sa
+clé publique. Un client inconnu ou dont la preuve est fausse reçoit
+"DENY <raison>". Une fois authentifié, il ne peut demander que les fichiers
+ou dossiers du serveur donnés pour son identité.
+
+Fichier d'identités, une identité par ligne ('#' pour les commentaires) :
+	<identité> hmac <secret en hex> <chemin>[,<chemin>...]
+	<identité> ed25519 <clé publique en hex> <chemin>[,<chemin>...]
+Les chemins sont relatifs au dossier servi, "*" donne accès à tout.
+
+Fichier secret du client (-secret), sur une ligne :
+	hmac <secret en hex>
+	ed25519 <graine de la clé privée en hex> */
+
+// identite décrit un client autorisé
+type identite struct {
+	nom     string
+	methode string            // "hmac" ou "ed25519"
+	secret  []byte            // secret partagé (hmac)
+	cle     ed25519.PublicKey // clé publique (ed25519)
+	chemins []string          // fichiers et dossiers accessibles
+}
+
+// lireIdentites charge le fichier d'identités du serveur
+func lireIdentites(chemin string) (map[string]*identite, error) {
+	fichier, err := os.Open(chemin)
+	if err != nil {
+		return nil, err
+	}
+	defer fichier.Close()
+
+	identites := make(map[string]*identite)
+	lignes := bufio.NewScanner(fichier)
+	for numero := 1; lignes.Scan(); numero++ {
+		ligne := strings.TrimSpace(lignes.Text())
+		if ligne == "" || strings.HasPrefix(ligne, "#") {
+			continue
+		}
+		champs := strings.Fields(ligne)
+		if len(champs) != 4 {
+			return nil, fmt.Errorf("%s:%d : <identité> <méthode> <clé> <chemins> attendus", chemin, numero)
+		}
+		cle, err := hex.DecodeString(champs[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d : clé invalide : %v", chemin, numero, err)
+		}
+		id := &identite{nom: champs[0], methode: champs[1]}
+		switch id.methode {
+		case "hmac":
+			id.secret = cle
+		case "ed25519":
+			if len(cle) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s:%d : une clé publique ed25519 fait %d octets", chemin, numero, ed25519.PublicKeySize)
+			}
+			id.cle = ed25519.PublicKey(cle)
+		default:
+			return nil, fmt.Errorf("%s:%d : méthode %q inconnue (hmac ou ed25519)", chemin, numero, id.methode)
+		}
+		for _, c := range strings.Split(champs[3], ",") {
+			id.chemins = append(id.chemins, nettoyerChemin(c))
+		}
+		identites[id.nom] = id
+	}
+	return identites, lignes.Err()
+}
+
+// messageAuth est ce que le client signe pour prouver son identité
+func messageAuth(nom, defi string) []byte {
+	return []byte("TCP_over_UDP " + nom + " " + defi)
+}
+
+// demanderAuthentification vérifie que le client annonce une identité connue
+// et ajoute le défi qu'il devra signer aux options de la réponse
+func demanderAuthentification(identites map[string]*identite, demande options, acceptees options) (*identite, error) {
+	nom, ok := demande["id"]
+	if !ok {
+		return nil, fmt.Errorf("authentification requise")
+	}
+	id := identites[nom]
+	if id == nil {
+		return nil, fmt.Errorf("identité %q inconnue", nom)
+	}
+	acceptees["defi"] = nouveauNonce()
+	return id, nil
+}
+
+// verifierPreuve contrôle la preuve "ACK preuve=<hex>" envoyée par le client
+func (id *identite) verifierPreuve(ack string, defi string) error {
+	champs := strings.Fields(ack)
+	preuve, err := hex.DecodeString(lireOptions(champs[1:])["preuve"])
+	if err != nil || len(preuve) == 0 {
+		return fmt.Errorf("preuve d'identité absente")
+	}
+	message := messageAuth(id.nom, defi)
+	valide := false
+	switch id.methode {
+	case "hmac":
+		mac := hmac.New(sha256.New, id.secret)
+		mac.Write(message)
+		valide = hmac.Equal(preuve, mac.Sum(nil))
+	case "ed25519":
+		valide = ed25519.Verify(id.cle, message, preuve)
+	}
+	if !valide {
+		return fmt.Errorf("preuve d'identité invalide pour %q", id.nom)
+	}
+	return nil
+}
+
+// nettoyerChemin met un chemin demandé sous la forme utilisée pour les droits
+func nettoyerChemin(chemin string) string {
+	if chemin == "*" {
+		return chemin
+	}
+	return strings.TrimPrefix(path.Clean("/"+chemin), "/")
+}
+
+// autorise indique si l'identité peut lire le fichier demandé
+func (id *identite) autorise(fichier string) bool {
+	fichier = nettoyerChemin(fichier)
+	for _, c := range id.chemins {
+		if c == "*" || c == "" || c == fichier || strings.HasPrefix(fichier, c+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// secretClient est ce qu'utilise le client Go pour prouver son identité
+type secretClient struct {
+	methode string
+	cle     []byte
+}
+
+// lireSecret charge le fichier secret du client
+func lireSecret(chemin string) (*secretClient, error) {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, err
+	}
+	champs := strings.Fields(string(contenu))
+	if len(champs) != 2 {
+		return nil, fmt.Errorf("%s : <méthode> <clé> attendus", chemin)
+	}
+	cle, err := hex.DecodeString(champs[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s : clé invalide : %v", chemin, err)
+	}
+	switch champs[0] {
+	case "hmac":
+	case "ed25519":
+		if len(cle) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s : une graine ed25519 fait %d octets", chemin, ed25519.SeedSize)
+		}
+	default:
+		return nil, fmt.Errorf("%s : méthode %q inconnue (hmac ou ed25519)", chemin, champs[0])
+	}
+	return &secretClient{methode: champs[0], cle: cle}, nil
+}
+
+// prouver calcule la preuve d'identité à renvoyer dans l'ACK
+func (s *secretClient) prouver(nom, defi string) string {
+	message := messageAuth(nom, defi)
+	if s.methode == "ed25519" {
+		return hex.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(s.cle), message))
+	}
+	mac := hmac.New(sha256.New, s.cle)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nouvelleCle tire une paire de clés ed25519 et renvoie le contenu du fichier
+// secret du client et la clé publique à mettre dans le fichier d'identités
+func nouvelleCle() (secret string, publique string) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	return "ed25519 " + hex.EncodeToString(priv.Seed()), hex.EncodeToString(pub)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*----------------------TESTS DE BOUT EN BOUT------------------- */
+/*-------------------------------------------------------------- */
+
+/* Ces tests lancent le serveur du scénario avec lequel ils sont compilés sur un
+port éphémère, lui font servir des clients Go comme le font les scripts
+multi_clients_*.sh, et vérifient que les fichiers reçus sont identiques, que
+le FIN termine chaque transfert et que le serveur referme tout ce qu'il a
+ouvert. « make test » les lance pour les trois scénarios. */
+
+// fichiers créés dans le dossier servi par chaque test (nom : taille en octets)
+var fichiersServis = map[string]int{"vide.txt": 0, "hey.txt": 13, "moyen.bin": 300_000, "gros.bin": 3_000_000}
+
+// profils de client : comme client1 (aucune option) et comme le client Go par défaut
+var profils = []struct {
+	nom     string
+	options options
+}{
+	{"client1", nil},
+	{"client-go", lireOptions(strings.Fields("meta sha256 crc32c compression=deflate,gzip pmtud rwnd"))},
+}
+
+// au-delà, ce qui devait se fermer ne l'a pas été
+const delaiNettoyage = 10 * time.Second
+
+func TestMain(m *testing.M) {
+	formatStats = "aucun"
+	_ = reglerJournal("error")
+	os.Exit(m.Run())
+}
+
+// serveurTest est un serveur lancé pour un test
+type serveurTest struct {
+	*serveur
+	dossier string // dossier servi
+	adresse string // ip:port de la socket d'écoute
+}
+
+// lancerServeur sert un dossier rempli de fichiersServis sur un port éphémère de
+// 127.0.0.1 ; regler peut changer la configuration avant le lancement. À la fin du
+// test, toutes les connexions doivent être fermées avec leurs sockets, et une fois
+// le serveur arrêté il ne doit rester ni socket ni goroutine de plus qu'avant.
+func lancerServeur(t *testing.T, regler func(*serveur)) *serveurTest {
+	t.Helper()
+	avant := ressourcesOuvertes()
+	dossier := t.TempDir()
+	for nom, taille := range fichiersServis {
+		if err := os.WriteFile(filepath.Join(dossier, nom), contenu(nom, taille), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	racine, err := os.OpenRoot(dossier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtre := new(atomic.Pointer[regles])
+	filtre.Store(&regles{})
+	srv := &serveur{reseau: "udp4", adresse: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, filtre: filtre, racine: racine, connexions: nouveauRegistre()}
+	if regler != nil {
+		regler(srv)
+	}
+
+	udp, err := net.ListenUDP(srv.reseau, srv.adresse)
+	if err != nil {
+		racine.Close()
+		t.Fatal(err)
+	}
+	connection := &socketEcoute{UDPConn: udp, conn: emuler(udp, srv.emulation)}
+	fini := make(chan error, 1)
+	go func() { fini <- srv.accueillir(connection) }()
+	enService := ressourcesOuvertes().descripteurs
+
+	t.Cleanup(func() {
+		attendre(t, func() string {
+			if n := srv.connexions.nombre(); n > 0 {
+				return fmt.Sprintf("%d connexion(s) encore ouverte(s)", n)
+			}
+			if n := ressourcesOuvertes().descripteurs; n != enService {
+				return fmt.Sprintf("%d descripteurs ouverts, %d avant les connexions", n, enService)
+			}
+			return ""
+		})
+		connection.Close()
+		if err := <-fini; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("le serveur s'est arrêté sur %v, pas sur la fermeture de sa socket", err)
+		}
+		racine.Close()
+		attendre(t, func() string {
+			if apres := ressourcesOuvertes(); apres != avant {
+				return fmt.Sprintf("descripteurs et goroutines : %v avant le serveur, %v après", avant, apres)
+			}
+			return ""
+		})
+	})
+	return &serveurTest{serveur: srv, dossier: dossier, adresse: udp.LocalAddr().String()}
+}
+
+// contenu renvoie les octets (toujours les mêmes) du fichier servi nom
+func contenu(nom string, taille int) []byte {
+	var graine [32]byte
+	copy(graine[:], nom)
+	b := make([]byte, taille)
+	_, _ = rand.NewChaCha8(graine).Read(b)
+	return b
+}
+
+// ressources compte ce qu'un serveur ou un client pourrait oublier de fermer
+type ressources struct {
+	descripteurs int
+	goroutines   int
+}
+
+func ressourcesOuvertes() ressources {
+	fds, _ := os.ReadDir("/proc/self/fd") //hors Linux, seules les goroutines sont comptées
+	return ressources{descripteurs: len(fds), goroutines: runtime.NumGoroutine()}
+}
+
+// attendre attend que probleme ne trouve plus rien à redire, ou échoue au bout de delaiNettoyage
+func attendre(t *testing.T, probleme func() string) {
+	t.Helper()
+	attendreDurant(t, delaiNettoyage, probleme)
+}
+
+// attendreDurant attend que probleme ne trouve plus rien à redire, ou échoue au bout de duree
+func attendreDurant(t *testing.T, duree time.Duration, probleme func() string) {
+	t.Helper()
+	limite := time.Now().Add(duree)
+	for {
+		p := probleme()
+		if p == "" {
+			return
+		}
+		if time.Now().After(limite) {
+			t.Error(p)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// demande prépare le téléchargement de nom vers le dossier dest
+func (s *serveurTest) demande(nom string, opts options, dest string) telechargement {
+	return telechargement{serveur: s.adresse, fichier: nom, sortie: filepath.Join(dest, "copy_"+nom), options: opts}
+}
+
+// verifierCopie compare le fichier reçu avec celui qui est servi
+func verifierCopie(t *testing.T, nom, copie string) {
+	t.Helper()
+	recu, err := os.ReadFile(copie)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if attendu := contenu(nom, fichiersServis[nom]); !bytes.Equal(recu, attendu) {
+		t.Errorf("%s : %d octets reçus différents des %d servis", nom, len(recu), len(attendu))
+	}
+}
+
+func TestTelechargement(t *testing.T) {
+	s := lancerServeur(t, nil)
+	t.Logf("scénario %s", scenario)
+	for _, p := range profils {
+		for nom := range fichiersServis {
+			t.Run(p.nom+"/"+nom, func(t *testing.T) {
+				dest := t.TempDir()
+				if err := telecharger(s.demande(nom, p.options, dest)); err != nil {
+					t.Fatal(err)
+				}
+				verifierCopie(t, nom, filepath.Join(dest, "copy_"+nom))
+			})
+		}
+	}
+}
+
+func TestClientsSimultanes(t *testing.T) {
+	s := lancerServeur(t, nil)
+	dest := t.TempDir()
+	var clients sync.WaitGroup
+	erreurs := make(chan error, 12)
+	for i := range 12 {
+		nom := []string{"gros.bin", "moyen.bin", "hey.txt"}[i%3]
+		p := profils[i%len(profils)]
+		sortie := filepath.Join(dest, strconv.Itoa(i))
+		if err := os.Mkdir(sortie, 0755); err != nil {
+			t.Fatal(err)
+		}
+		clients.Go(func() {
+			if err := telecharger(s.demande(nom, p.options, sortie)); err != nil {
+				erreurs <- fmt.Errorf("client %d (%s, %s) : %w", i, p.nom, nom, err)
+				return
+			}
+			verifierCopie(t, nom, filepath.Join(sortie, "copy_"+nom))
+		})
+	}
+	clients.Wait()
+	close(erreurs)
+	for err := range erreurs {
+		t.Error(err)
+	}
+}
+
+func TestPlusieursFichiers(t *testing.T) {
+	s := lancerServeur(t, nil)
+	fichiers := []string{"gros.bin", "hey.txt", "vide.txt", "moyen.bin"}
+	for _, cas := range []struct {
+		nom     string
+		obtenir func(telechargement, []string) ([]string, error)
+	}{
+		{"flux", func(d telechargement, f []string) ([]string, error) { return telechargerFlux(d, f, 2) }},
+		{"session", telechargerSession},
+	} {
+		t.Run(cas.nom, func(t *testing.T) {
+			//les fichiers reçus sont écrits dans le dossier courant, comme avec le client
+			dest := t.TempDir()
+			t.Chdir(dest)
+			corrompus, err := cas.obtenir(s.demande("", profils[1].options, dest), fichiers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(corrompus) > 0 {
+				t.Fatalf("fichiers corrompus : %v", corrompus)
+			}
+			for _, nom := range fichiers {
+				verifierCopie(t, nom, filepath.Join(dest, "copy_"+nom))
+			}
+		})
+	}
+}
+
+// Un client qui a négocié un seul flux en ouvre trois : le serveur ne sert que le premier.
+func TestFluxAuDelaDuNombreNegocie(t *testing.T) {
+	s := lancerServeur(t, nil)
+	d := s.demande("hey.txt", profils[1].options, t.TempDir())
+	d.options = maps.Clone(d.options)
+	d.options["flux"] = "1"
+	conn, dataConn, donnees, opts, err := connecter(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if opts["flux"] != "1" {
+		t.Fatalf("flux=1 attendu, accepté %q", opts["flux"])
+	}
+	m := multiplexer(dataConn, donnees, 0, horlogeSysteme{})
+	defer m.fermer()
+
+	demande := []byte("hey.txt\x00")
+	var flux []*flux
+	for numero := 1; numero <= 3; numero++ {
+		f, err := m.ouvrir(numero)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteTo(demande, donnees); err != nil {
+			t.Fatal(err)
+		}
+		flux = append(flux, f)
+	}
+	c := &connexion{conn: flux[0], addr: donnees, options: opts}
+	if err := recevoirFichier(c, d.sortie, demande, reglagesReception{}); err != nil {
+		t.Fatal(err)
+	}
+	verifierCopie(t, "hey.txt", d.sortie)
+	for _, f := range flux[1:] {
+		f.SetReadDeadline(time.Now().Add(delaiControle))
+		if _, _, err := f.ReadFrom(make([]byte, 1500)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("flux %d : rien n'était attendu, reçu %v", f.numero, err)
+		}
+	}
+	if _, err := m.ouvrir(numeroFluxMax + 1); !errors.Is(err, errNumeroFlux) {
+		t.Errorf("flux %d : %v attendu, reçu %v", numeroFluxMax+1, errNumeroFlux, err)
+	}
+}
+
+func TestDepot(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "moyen.bin")
+	if err := os.WriteFile(local, contenu("moyen.bin", fichiersServis["moyen.bin"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("clair", func(t *testing.T) {
+		s := lancerServeur(t, func(srv *serveur) { srv.depot = true })
+		d := s.demande(local, profils[1].options, "")
+		d.sortie = "depose.bin"
+		if err := deposer(d); err != nil {
+			t.Fatal(err)
+		}
+		verifierCopie(t, "moyen.bin", filepath.Join(s.dossier, "depose.bin"))
+	})
+
+	//le premier FIN-ACK se perd : le serveur doit lire le FIN répété, chiffré et
+	//portant l'empreinte, et confirmer à nouveau
+	t.Run("psk+sha256/FIN-ACK perdu", func(t *testing.T) {
+		psk := []byte("clé partagée des tests")
+		s := lancerServeur(t, func(srv *serveur) { srv.depot, srv.psk = true, psk })
+		d := s.demande(local, profils[1].options, "")
+		d.sortie, d.psk = "depose.bin", psk
+		d.options = maps.Clone(d.options)
+		d.options["put"] = ""
+		conn, dataConn, serveur, opts, err := connecter(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		c := &connexion{conn: &finAckPerdu{PacketConn: dataConn}, addr: serveur, options: opts}
+		if err := attendreReponse(c, append([]byte("PUT "+d.sortie), 0), "PRET"); err != nil {
+			t.Fatal(err)
+		}
+		fichier, err := os.Open(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fichier.Close()
+		fin, err := envoyer(c, fichier, local, reglagesDepot, nouvellesStatistiques(local, serveur, c.temps()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := attendreReponse(c, fin, "FIN-ACK"); err != nil {
+			t.Fatal(err)
+		}
+		if !c.conn.(*finAckPerdu).perdu {
+			t.Error("aucun FIN-ACK perdu")
+		}
+		verifierCopie(t, "moyen.bin", filepath.Join(s.dossier, "depose.bin"))
+	})
+}
+
+// finAckPerdu perd le premier FIN-ACK reçu
+type finAckPerdu struct {
+	net.PacketConn
+	perdu bool
+}
+
+func (f *finAckPerdu) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := f.PacketConn.ReadFrom(b)
+		if err != nil || f.perdu || string(b[:n]) != "FIN-ACK" {
+			return n, addr, err
+		}
+		f.perdu = true
+	}
+}
+
+// Un dépôt ne remplace pas un fichier servi et ne dépasse pas -depotMax ; il ne laisse rien derrière lui.
+func TestDepotRefuse(t *testing.T) {
+	s := lancerServeur(t, func(srv *serveur) { srv.depot, srv.depotMax = true, int64(fichiersServis["moyen.bin"]-1) })
+	local := filepath.Join(t.TempDir(), "moyen.bin")
+	if err := os.WriteFile(local, contenu("moyen.bin", fichiersServis["moyen.bin"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, cas := range []struct{ options, sortie, raison string }{
+		{"", "hey.txt", "existe déjà"},
+		{"", "trop_gros.bin", "plus gros que"},
+		{"meta", "trop_gros.bin", "plus gros que"},
+	} {
+		d := s.demande(local, lireOptions(strings.Fields(cas.options)), "")
+		d.sortie = cas.sortie
+		if err := deposer(d); err == nil || !strings.Contains(err.Error(), cas.raison) {
+			t.Errorf("options %q, dépôt de %s : %q attendu, reçu %v", cas.options, cas.sortie, cas.raison, err)
+		}
+	}
+	verifierCopie(t, "hey.txt", filepath.Join(s.dossier, "hey.txt"))
+	entrees, err := os.ReadDir(s.dossier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entrees) != len(fichiersServis) {
+		t.Errorf("%d fichiers dans le dossier servi, %d attendus", len(entrees), len(fichiersServis))
+	}
+}
+
+// Avec -max, le client refuse un fichier trop gros, annoncé par META ou non.
+func TestTelechargementTropGros(t *testing.T) {
+	s := lancerServeur(t, nil)
+	for _, opts := range []string{"", "meta"} {
+		d := s.demande("moyen.bin", lireOptions(strings.Fields(opts)), t.TempDir())
+		d.max = int64(fichiersServis["moyen.bin"] - 1)
+		if err := telecharger(d); err == nil || !strings.Contains(err.Error(), "plus gros que") {
+			t.Errorf("options %q : fichier trop gros attendu, reçu %v", opts, err)
+		}
+	}
+}
+
+func TestFichierIntrouvable(t *testing.T) {
+	s := lancerServeur(t, nil)
+	err := telecharger(s.demande("absent.bin", profils[1].options, t.TempDir()))
+	if !errors.Is(err, errRefus) {
+		t.Fatalf("DENY attendu, reçu %v", err)
+	}
+}
+
+// Le client1 d'origine ne sait pas redemander le FIN : s'il se perd, le client
+// rappelle son dernier ACK et le serveur, qui ne ferme pas tout de suite, le renvoie.
+func TestFinPerdu(t *testing.T) {
+	s := lancerServeur(t, nil)
+	ecoute, err := net.ResolveUDPAddr("udp4", s.adresse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	lire := func() string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(delaiFermeture))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	//handshake et demande, comme client1
+	if _, err := conn.WriteTo([]byte("SYN"), ecoute); err != nil {
+		t.Fatal(err)
+	}
+	synAck := lire()
+	port, err := strconv.Atoi(strings.TrimPrefix(nettoyer([]byte(synAck)), "SYN-ACK"))
+	if err != nil {
+		t.Fatalf("SYN-ACK attendu, reçu %q", synAck)
+	}
+	donnees := &net.UDPAddr{IP: ecoute.IP, Port: port}
+	_, _ = conn.WriteTo([]byte("ACK"), ecoute)
+	_, _ = conn.WriteTo([]byte("hey.txt\x00"), donnees)
+
+	segment := lire()
+	if want := "000001" + string(contenu("hey.txt", fichiersServis["hey.txt"])); segment != want {
+		t.Fatalf("segment 1 attendu, reçu %q", segment)
+	}
+	_, _ = conn.WriteTo([]byte("ACK000001"), donnees)
+	if fin := lire(); !strings.HasPrefix(fin, "FIN") {
+		t.Fatalf("FIN attendu, reçu %q", fin)
+	}
+
+	//le FIN s'est « perdu » : le client rappelle son dernier ACK
+	_, _ = conn.WriteTo([]byte("ACK000001"), donnees)
+	if fin := lire(); !strings.HasPrefix(fin, "FIN") {
+		t.Fatalf("FIN renvoyé attendu, reçu %q", fin)
+	}
+}
+
+// Le client ferme sa socket au milieu d'un téléchargement : le serveur, qui n'a plus
+// de nouvelles, renonce et ne garde ni la connexion ni les goroutines de l'envoi.
+func TestClientDisparu(t *testing.T) {
+	s := lancerServeur(t, nil)
+	avant := ressourcesOuvertes().goroutines
+	ecoute, err := net.ResolveUDPAddr("udp4", s.adresse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	lire := func() string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(delaiControle))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	//handshake et demande, comme client1, puis quelques segments acquittés
+	if _, err := conn.WriteTo([]byte("SYN"), ecoute); err != nil {
+		t.Fatal(err)
+	}
+	synAck := lire()
+	port, err := strconv.Atoi(strings.TrimPrefix(nettoyer([]byte(synAck)), "SYN-ACK"))
+	if err != nil {
+		t.Fatalf("SYN-ACK attendu, reçu %q", synAck)
+	}
+	donnees := &net.UDPAddr{IP: ecoute.IP, Port: port}
+	_, _ = conn.WriteTo([]byte("ACK"), ecoute)
+	_, _ = conn.WriteTo([]byte("gros.bin\x00"), donnees)
+	for range 3 {
+		if segment := lire(); len(segment) < 6 {
+			t.Fatalf("segment attendu, reçu %q", segment)
+		}
+	}
+	_, _ = conn.WriteTo([]byte("ACK000001"), donnees)
+	if s.connexions.nombre() != 1 {
+		t.Fatalf("%d connexions pendant le transfert, 1 attendue", s.connexions.nombre())
+	}
+	conn.Close()
+
+	//le serveur renonce après essaisInactivite délais sans nouvelles, puis attend un éventuel dernier message
+	attendreDurant(t, essaisInactivite*delaiControle+delaiFermeture+delaiNettoyage, func() string {
+		if n := s.connexions.nombre(); n > 0 {
+			return fmt.Sprintf("%d connexion(s) encore ouverte(s)", n)
+		}
+		if n := ressourcesOuvertes().goroutines; n != avant {
+			return fmt.Sprintf("%d goroutines, %d avant le transfert", n, avant)
+		}
+		return ""
+	})
+}
+
+// conditions du scénario 2 : pertes, latence variable, désordre et doublons
+func TestEmulation(t *testing.T) {
+	for graine := uint64(1); graine <= 3; graine++ {
+		t.Run(fmt.Sprintf("graine=%d", graine), func(t *testing.T) {
+			reglagesServeur, err := lireEmulation(fmt.Sprintf("perte=3%% rafales=1%%/40%% delai=2ms gigue=1ms desordre=1%% double=1%% graine=%d", graine))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reglagesClient, err := lireEmulation(fmt.Sprintf("perte=2%% delai=2ms graine=%d", graine))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := lancerServeur(t, func(srv *serveur) { srv.emulation = reglagesServeur })
+			dest := t.TempDir()
+			var clients sync.WaitGroup
+			for i, p := range profils {
+				for _, nom := range []string{"moyen.bin", "hey.txt"} {
+					sortie := filepath.Join(dest, strconv.Itoa(i))
+					if err := os.MkdirAll(sortie, 0755); err != nil {
+						t.Fatal(err)
+					}
+					clients.Go(func() {
+						d := s.demande(nom, p.options, sortie)
+						d.emulation = reglagesClient
+						if err := telecharger(d); err != nil {
+							t.Errorf("%s, %s : %v", p.nom, nom, err)
+							return
+						}
+						verifierCopie(t, nom, filepath.Join(sortie, "copy_"+nom))
+					})
+				}
+			}
+			clients.Wait()
+		})
+	}
+}
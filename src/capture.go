@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*----------------------CAPTURE EN PCAPNG----------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec -capture <fichier>, le serveur écrit chaque datagramme envoyé ou reçu,
+sur la socket d'écoute et sur les sockets de données, dans un fichier pcapng
+que lisent Wireshark et tcpdump sans être root. Le serveur ne voit que la
+charge UDP : il reconstruit les en-têtes IP et UDP (type de lien RAW, sommes de
+contrôle comprises) avec l'adresse du client et l'adresse locale, c'est-à-dire
+celle de -ecoute, ou sinon celle par laquelle le système joint le client. Ce qui
+passe sur une connexion chiffrée est capturé chiffré, comme sur le réseau. Le
+sens du paquet est noté dans l'option epb_flags de chaque bloc. Les blocs
+passent par un tampon vidé toutes les periodeCapture et à la fermeture (y
+compris sur ^C), pour que les envois des clients n'attendent pas le disque. */
+
+const (
+	blocSection   = 0x0A0D0D0A
+	blocInterface = 1
+	blocPaquet    = 6
+	lienRaw       = 101 // LINKTYPE_RAW : le paquet commence par l'en-tête IPv4 ou IPv6
+	snapLen       = 65535
+
+	sensEntrant = 1 // epb_flags : paquet reçu
+	sensSortant = 2 // epb_flags : paquet envoyé
+
+	tamponCapture  = 256 * 1024             // taille du tampon d'écriture
+	periodeCapture = 500 * time.Millisecond // intervalle entre deux écritures du tampon
+)
+
+// capture est le fichier pcapng partagé par toutes les sockets du serveur
+type capture struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	ipID    uint16                    // identifiant des en-têtes IPv4 reconstruits
+	locales map[netip.Addr]netip.Addr // adresse locale utilisée pour joindre chaque client
+	arret   chan struct{}             // fermé par fermer : le vidage périodique s'arrête
+	arrete  chan struct{}             // fermé quand il s'est arrêté
+	fermee  bool
+}
+
+// ouvrirCapture crée le fichier et y écrit l'en-tête de section et la description de l'interface
+func ouvrirCapture(nom string) (*capture, error) {
+	f, err := os.Create(nom)
+	if err != nil {
+		return nil, err
+	}
+	c := &capture{f: f, w: bufio.NewWriterSize(f, tamponCapture), locales: make(map[netip.Addr]netip.Addr), arret: make(chan struct{}), arrete: make(chan struct{})}
+
+	//en-tête de section : ordre des octets, version 1.0, longueur inconnue
+	section := binary.LittleEndian.AppendUint32(nil, 0x1A2B3C4D)
+	section = binary.LittleEndian.AppendUint16(section, 1)
+	section = binary.LittleEndian.AppendUint16(section, 0)
+	section = binary.LittleEndian.AppendUint64(section, 0xFFFFFFFFFFFFFFFF)
+	section = append(section, optionPcapng(4, []byte("serveur LesTryhardeusesDuDimanche"))...) //shb_userappl
+	section = append(section, optionPcapng(0, nil)...)
+	c.bloc(blocSection, section)
+
+	//interface unique, horodatage en microsecondes (valeur par défaut)
+	iface := binary.LittleEndian.AppendUint16(nil, lienRaw)
+	iface = binary.LittleEndian.AppendUint16(iface, 0)
+	iface = binary.LittleEndian.AppendUint32(iface, snapLen)
+	iface = append(iface, optionPcapng(2, []byte("udp"))...) //if_name
+	iface = append(iface, optionPcapng(0, nil)...)
+	c.bloc(blocInterface, iface)
+
+	if err := c.w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	go c.vider()
+	return c, nil
+}
+
+// vider écrit le tampon toutes les periodeCapture, jusqu'à la fermeture
+func (c *capture) vider() {
+	defer close(c.arrete)
+	minuteur := time.NewTicker(periodeCapture)
+	defer minuteur.Stop()
+	for {
+		select {
+		case <-c.arret:
+			return
+		case <-minuteur.C:
+			c.mu.Lock()
+			_ = c.w.Flush()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// optionPcapng code une option (code, longueur, valeur complétée à 4 octets)
+func optionPcapng(code uint16, valeur []byte) []byte {
+	o := binary.LittleEndian.AppendUint16(nil, code)
+	o = binary.LittleEndian.AppendUint16(o, uint16(len(valeur)))
+	o = append(o, valeur...)
+	for len(o)%4 != 0 {
+		o = append(o, 0)
+	}
+	return o
+}
+
+// bloc écrit un bloc pcapng : type, longueur, corps complété à 4 octets, longueur
+func (c *capture) bloc(genre uint32, corps []byte) {
+	for len(corps)%4 != 0 {
+		corps = append(corps, 0)
+	}
+	longueur := uint32(len(corps) + 12)
+	b := binary.LittleEndian.AppendUint32(nil, genre)
+	b = binary.LittleEndian.AppendUint32(b, longueur)
+	b = append(b, corps...)
+	b = binary.LittleEndian.AppendUint32(b, longueur)
+	_, _ = c.w.Write(b)
+}
+
+// fermer écrit ce qui reste et ferme le fichier ; les datagrammes suivants ne sont plus capturés
+func (c *capture) fermer() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	if c.fermee {
+		c.mu.Unlock()
+		return nil
+	}
+	c.fermee = true
+	c.mu.Unlock()
+	close(c.arret)
+	<-c.arrete
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.w.Flush(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+// locale renvoie l'adresse par laquelle le serveur joint distant, quand la socket
+// écoute sur toutes les adresses (c.mu est tenu)
+func (c *capture) locale(socket, distant netip.Addr) netip.Addr {
+	if !socket.IsUnspecified() {
+		return socket.Unmap()
+	}
+	if ip, ok := c.locales[distant]; ok {
+		return ip
+	}
+	ip := socket.Unmap()
+	if distant.Is4() {
+		ip = netip.IPv4Unspecified()
+	}
+	//une socket UDP « connectée » ne fait que demander la route au système : rien n'est envoyé
+	if conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(distant, 9))); err == nil {
+		if a, ok := netip.AddrFromSlice(conn.LocalAddr().(*net.UDPAddr).IP); ok {
+			ip = a.Unmap()
+		}
+		conn.Close()
+	}
+	c.locales[distant] = ip
+	return ip
+}
+
+// paquet enregistre un datagramme échangé entre la socket locale et distant
+func (c *capture) paquet(sens uint32, local net.Addr, distant net.Addr, charge []byte) {
+	l, ok1 := local.(*net.UDPAddr)
+	d, ok2 := distant.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return
+	}
+	date := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fermee {
+		return
+	}
+
+	pd := d.AddrPort()
+	pd = netip.AddrPortFrom(pd.Addr().Unmap(), pd.Port())
+	pl := netip.AddrPortFrom(c.locale(l.AddrPort().Addr(), pd.Addr()), uint16(l.Port))
+	src, dst := pl, pd
+	if sens == sensEntrant {
+		src, dst = pd, pl
+	}
+	c.ipID++
+	ip := paquetIP(src, dst, charge, c.ipID)
+
+	//bloc de paquet amélioré : interface 0, date en microsecondes, longueurs, données, sens
+	micro := uint64(date.UnixMicro())
+	corps := binary.LittleEndian.AppendUint32(nil, 0)
+	corps = binary.LittleEndian.AppendUint32(corps, uint32(micro>>32))
+	corps = binary.LittleEndian.AppendUint32(corps, uint32(micro))
+	corps = binary.LittleEndian.AppendUint32(corps, uint32(min(len(ip), snapLen)))
+	corps = binary.LittleEndian.AppendUint32(corps, uint32(len(ip)))
+	corps = append(corps, ip[:min(len(ip), snapLen)]...)
+	for len(corps)%4 != 0 {
+		corps = append(corps, 0)
+	}
+	corps = append(corps, optionPcapng(2, binary.LittleEndian.AppendUint32(nil, sens))...) //epb_flags
+	corps = append(corps, optionPcapng(0, nil)...)
+	c.bloc(blocPaquet, corps)
+}
+
+// paquetIP reconstruit les en-têtes IPv4 ou IPv6 et UDP autour de la charge
+func paquetIP(src, dst netip.AddrPort, charge []byte, id uint16) []byte {
+	udp := binary.BigEndian.AppendUint16(nil, src.Port())
+	udp = binary.BigEndian.AppendUint16(udp, dst.Port())
+	udp = binary.BigEndian.AppendUint16(udp, uint16(8+len(charge)))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, charge...)
+
+	//pseudo-en-tête de la somme de contrôle UDP : adresses, protocole, longueur
+	somme := sommeInternet(0, src.Addr().AsSlice())
+	somme = sommeInternet(somme, dst.Addr().AsSlice())
+	somme = sommeInternet(somme, []byte{0, 17})
+	somme = sommeInternet(somme, binary.BigEndian.AppendUint16(nil, uint16(len(udp))))
+	controle := finirSomme(sommeInternet(somme, udp))
+	if controle == 0 {
+		controle = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(udp[6:], controle)
+
+	if src.Addr().Is4() {
+		ip := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, 17, 0, 0} //DF, TTL 64, UDP
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		binary.BigEndian.PutUint16(ip[4:], id)
+		ip = append(ip, src.Addr().AsSlice()...)
+		ip = append(ip, dst.Addr().AsSlice()...)
+		binary.BigEndian.PutUint16(ip[10:], finirSomme(sommeInternet(0, ip)))
+		return append(ip, udp...)
+	}
+	ip := []byte{0x60, 0, 0, 0, 0, 0, 17, 64} //version 6, UDP, 64 sauts
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip = append(ip, src.Addr().AsSlice()...)
+	ip = append(ip, dst.Addr().AsSlice()...)
+	return append(ip, udp...)
+}
+
+// sommeInternet ajoute des mots de 16 bits à la somme de contrôle (RFC 1071)
+func sommeInternet(somme uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		somme += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		somme += uint32(b[0]) << 8
+	}
+	return somme
+}
+
+func finirSomme(somme uint32) uint16 {
+	for somme>>16 != 0 {
+		somme = somme&0xFFFF + somme>>16
+	}
+	return ^uint16(somme)
+}
+
+// connCapturee enregistre ce qui passe sur une socket de données
+type connCapturee struct {
+	net.PacketConn
+	capture *capture
+}
+
+// capturer renvoie conn, qui enregistre ses datagrammes si pcap n'est pas nil
+func capturer(conn net.PacketConn, pcap *capture) net.PacketConn {
+	if pcap == nil {
+		return conn
+	}
+	return &connCapturee{PacketConn: conn, capture: pcap}
+}
+
+func (c *connCapturee) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.capture.paquet(sensSortant, c.LocalAddr(), addr, p)
+	}
+	return n, err
+}
+
+func (c *connCapturee) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.capture.paquet(sensEntrant, c.LocalAddr(), addr, p[:n])
+	}
+	return n, addr, err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------------CHIFFREMENT------------------------ */
+/*-------------------------------------------------------------- */
+
+/* Avec une clé partagée (PSK), le client ajoute à son SYN "aead=aes-256-gcm nc=<hex>"
+(nc : 16 octets aléatoires) et le serveur répond "aead=aes-256-gcm ns=<hex>".
+Chaque côté dérive alors avec HKDF-SHA256(PSK, nc||ns) une clé AES-256 par sens.
+Tout ce qui passe ensuite sur la socket de données (nom du fichier, META,
+segments, ACK, FIN) est chiffré et authentifié :
+	<numéro de paquet sur 8 octets, big endian><données chiffrées><tag de 16 octets>
+Le nonce est le numéro de paquet, propre à chaque sens et jamais réutilisé.
+Un datagramme qui ne s'authentifie pas est jeté sans réponse. */
+
+const algoChiffrement = "aes-256-gcm"
+
+// surcoût d'un datagramme chiffré : numéro de paquet + tag
+const surcoutAEAD = 8 + 16
+
+// clesSession contient les clés d'une connexion, une par sens
+type clesSession struct {
+	emission  cipher.AEAD
+	reception cipher.AEAD
+}
+
+// lireCle lit la clé partagée dans un fichier (en hexadécimal, ou brute sinon)
+func lireCle(chemin string) ([]byte, error) {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, err
+	}
+	contenu = bytes.TrimSpace(contenu)
+	cle, err := hex.DecodeString(string(contenu))
+	if err != nil {
+		cle = contenu
+	}
+	if len(cle) < 16 {
+		return nil, fmt.Errorf("%s : la clé partagée doit faire au moins 16 octets", chemin)
+	}
+	return cle, nil
+}
+
+// nouveauNonce tire les 16 octets aléatoires échangés dans le handshake
+func nouveauNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// surcoutChiffrement renvoie ce que le chiffrement ajoute à chaque datagramme
+func surcoutChiffrement(opts options) int {
+	if opts.a("aead") {
+		return surcoutAEAD
+	}
+	return 0
+}
+
+// deriverCles calcule les clés de session à partir de la PSK et des deux nonces du handshake
+func deriverCles(psk []byte, nc, ns string, serveur bool) (*clesSession, error) {
+	bnc, err := hex.DecodeString(nc)
+	if err != nil || len(bnc) != 16 {
+		return nil, fmt.Errorf("nonce client invalide")
+	}
+	bns, err := hex.DecodeString(ns)
+	if err != nil || len(bns) != 16 {
+		return nil, fmt.Errorf("nonce serveur invalide")
+	}
+	sel := append(bnc, bns...)
+
+	aead := func(sens string) (cipher.AEAD, error) {
+		cle, err := hkdf.Key(sha256.New, psk, sel, "TCP_over_UDP "+sens, 32)
+		if err != nil {
+			return nil, err
+		}
+		bloc, err := aes.NewCipher(cle)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(bloc)
+	}
+	versServeur, err := aead("client->serveur")
+	if err != nil {
+		return nil, err
+	}
+	versClient, err := aead("serveur->client")
+	if err != nil {
+		return nil, err
+	}
+	if serveur {
+		return &clesSession{emission: versClient, reception: versServeur}, nil
+	}
+	return &clesSession{emission: versServeur, reception: versClient}, nil
+}
+
+// accepterChiffrement vérifie la demande de chiffrement d'un client, complète les
+// options de la réponse et renvoie les clés de la connexion
+func accepterChiffrement(psk []byte, demande options, acceptees options) (*clesSession, error) {
+	if demande["aead"] != algoChiffrement {
+		return nil, fmt.Errorf("chiffrement %s requis", algoChiffrement)
+	}
+	ns := nouveauNonce()
+	cles, err := deriverCles(psk, demande["nc"], ns, true)
+	if err != nil {
+		return nil, err
+	}
+	acceptees["aead"] = algoChiffrement
+	acceptees["ns"] = ns
+	return cles, nil
+}
+
+// connChiffree chiffre tout ce qui est écrit et ne laisse passer en lecture
+// que les datagrammes authentifiés
+type connChiffree struct {
+	net.PacketConn
+	cles   *clesSession
+	numero atomic.Uint64 //numéro du prochain paquet émis
+	rejeu  fenetreRejeu  //numéros des paquets déjà reçus
+}
+
+func chiffrer(conn net.PacketConn, cles *clesSession) net.PacketConn {
+	return &connChiffree{PacketConn: conn, cles: cles}
+}
+
+func nonce(numero []byte) []byte {
+	n := make([]byte, 12)
+	copy(n[4:], numero)
+	return n
+}
+
+func (c *connChiffree) WriteTo(b []byte, addr net.Addr) (int, error) {
+	paquet := make([]byte, 8, 8+len(b)+16)
+	binary.BigEndian.PutUint64(paquet, c.numero.Add(1)-1)
+	paquet = c.cles.emission.Seal(paquet, nonce(paquet[:8]), b, nil)
+	if _, err := c.PacketConn.WriteTo(paquet, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *connChiffree) ReadFrom(b []byte) (int, net.Addr, error) {
+	paquet := make([]byte, len(b)+surcoutAEAD)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(paquet)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n < surcoutAEAD {
+			continue
+		}
+		clair, err := c.cles.reception.Open(nil, nonce(paquet[:8]), paquet[8:n], nil)
+		if err != nil {
+			continue //datagramme non authentifié : on l'ignore
+		}
+		if !c.rejeu.nouveau(numeroPaquet(paquet)) {
+			continue //datagramme rejoué
+		}
+		return copy(b, clair), addr, nil
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*-------------------------------------------------------------- */
+/*-----------------------------MAIN----------------------------- */
+/*-------------------------------------------------------------- */
+
+// Client Go : même usage que client1, mais il sait négocier les extensions du protocole
+func main() {
+	sortie := flag.String("o", "", "fichier de sortie (par défaut copy_<nom fichier>)")
+	demande := flag.String("options", "meta sha256 crc32c compression=deflate,gzip pmtud rwnd", "options demandées au serveur, séparées par des espaces (\"\" : comme client1)")
+	silence := flag.Bool("q", false, "ne pas afficher la progression")
+	essais := flag.Int("essais", 3, "nombre de téléchargements tentés si le fichier reçu est corrompu")
+	fichierPSK := flag.String("psk", "", "fichier contenant la clé partagée avec le serveur (chiffre la connexion)")
+	nom := flag.String("id", "", "identité annoncée au serveur")
+	fichierSecret := flag.String("secret", "", "fichier secret prouvant l'identité (\"hmac <hex>\" ou \"ed25519 <hex>\")")
+	nouvelle := flag.String("nouvelle-cle", "", "crée une paire de clés ed25519 dans ce fichier secret et affiche la clé publique")
+	put := flag.Bool("put", false, "envoyer <nom fichier> au serveur (sous le nom donné par -o) au lieu de le télécharger")
+	ls := flag.Bool("ls", false, "lister le dossier <nom fichier> du serveur (la racine servie s'il est omis)")
+	stat := flag.Bool("stat", false, "afficher la taille et la date de <nom fichier> sur le serveur")
+	formatStats := flag.String("stats", "aucun", "avec -put, bilan affiché à la fin de l'envoi : ligne, json ou aucun")
+	nbFlux := flag.Int("flux", 4, "avec plusieurs fichiers, nombre de fichiers reçus en même temps sur la connexion (0 : l'un après l'autre)")
+	dossierTrace := flag.String("trace", "", "avec -put, dossier où écrire la trace de l'envoi (JSON par ligne, façon qlog)")
+	reglagesReseau := flag.String("emulation", "", "conditions du réseau émulé : \"perte=2% rafales=1%/30% delai=20ms gigue=5ms debit=10M desordre=1% double=1%\"")
+	niveau := flag.String("journal", "warn", "niveau du journal (sur la sortie d'erreur) : paquets, debug, info, warn ou error")
+	tailleMax := flag.Int64("max", 0, "taille maximale d'un fichier reçu, en octets (0 : pas de limite)")
+	mss := flag.Int("mss", 0, "plus grand datagramme accepté, annoncé avec les options (0 : la MTU de l'interface, -1 : ne pas l'annoncer)")
+	flag.Usage = func() {
+		fmt.Println("Usage : ./client [-put | -ls | -stat] [-o sortie] [-options \"meta sha256 crc32c compression=deflate,gzip pmtud rwnd\"] [-q] [-essais n] [-psk fichier] [-id identité -secret fichier] [-mss octets] [-max octets] [-flux n] [-stats ligne|json] [-journal niveau] [-trace dossier] [-emulation réglages] <IP serveur> <port serveur> <nom fichier>...")
+	}
+	flag.Parse()
+	if *nouvelle != "" {
+		secret, publique := nouvelleCle()
+		if err := os.WriteFile(*nouvelle, []byte(secret+"\n"), 0600); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Clé publique à mettre dans le fichier d'identités du serveur :", publique)
+		return
+	}
+	consultation := ""
+	if *ls {
+		consultation = "LIST"
+	} else if *stat {
+		consultation = "STAT"
+	}
+	if (flag.NArg() < 3 && !(*ls && flag.NArg() == 2)) || (flag.NArg() > 3 && (*sortie != "" || *put || consultation != "")) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := reglerJournal(*niveau); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	emulation, err := lireEmulation(*reglagesReseau)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	t := telechargement{
+		serveur:     net.JoinHostPort(flag.Arg(0), flag.Arg(1)),
+		fichier:     flag.Arg(2),
+		sortie:      *sortie,
+		options:     lireOptions(strings.Fields(*demande)),
+		progression: !*silence,
+		stats:       *formatStats,
+		mss:         *mss,
+		trace:       *dossierTrace,
+		emulation:   emulation,
+		max:         *tailleMax,
+	}
+	if *fichierPSK != "" {
+		psk, err := lireCle(*fichierPSK)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		t.psk = psk
+	}
+	if *nom != "" {
+		secret, err := lireSecret(*fichierSecret)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		t.identite, t.secret = *nom, secret
+	}
+	if consultation != "" {
+		reponse, err := consulter(t, consultation, flag.Arg(2))
+		if err == nil {
+			err = afficherListe(consultation, reponse)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *put {
+		//dépôt : le fichier garde son nom sur le serveur, sauf avec -o
+		if t.sortie == "" {
+			t.sortie = filepath.Base(t.fichier)
+		}
+		if err := deposer(t); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() > 3 {
+		//plusieurs fichiers : une seule connexion, avec des flux ou une session si le serveur le permet
+		fichiers := flag.Args()[2:]
+		for essai := 1; ; essai++ {
+			var corrompus []string
+			err := errSansFlux
+			if *nbFlux > 0 {
+				corrompus, err = telechargerFlux(t, fichiers, *nbFlux)
+			}
+			if errors.Is(err, errSansFlux) {
+				corrompus, err = telechargerSession(t, fichiers)
+			}
+			if errors.Is(err, errSansSession) {
+				break
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if len(corrompus) == 0 {
+				return
+			}
+			if essai >= *essais {
+				os.Exit(1)
+			}
+			fmt.Println("Nouvel essai...")
+			fichiers = corrompus
+		}
+		//le serveur ne gère pas les sessions : un téléchargement par fichier
+		for _, fichier := range fichiers {
+			t.fichier, t.sortie = fichier, "copy_"+filepath.Base(fichier)
+			if err := telecharger(t); err != nil {
+				fmt.Println(fichier, ":", err)
+				os.Remove(t.sortie)
+			}
+		}
+		return
+	}
+	if t.sortie == "" {
+		t.sortie = "copy_" + filepath.Base(t.fichier)
+	}
+
+	for essai := 1; ; essai++ {
+		err := telecharger(t)
+		if err == nil {
+			if n := segmentsCorrompus.Load(); n > 0 {
+				fmt.Println(n, "segment(s) corrompu(s) reçu(s) et redemandé(s)")
+			}
+			return
+		}
+		fmt.Println(err)
+		if !errors.Is(err, errIntegrite) {
+			os.Exit(1)
+		}
+		//on ne garde jamais un fichier corrompu : on le redemande entièrement
+		os.Remove(t.sortie)
+		if essai >= *essais {
+			os.Exit(1)
+		}
+		fmt.Println("Nouvel essai...")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*-------------------------------------------------------------- */
+/*-------------------------COMPRESSION-------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "compression=<algo>[,<algo>...]" le client donne les algorithmes
+qu'il sait décompresser par ordre de préférence, le serveur répond avec celui
+qu'il a choisi ("compression=deflate"). Chaque segment est compressé seul pour
+qu'il reste décodable même si ses voisins sont perdus. Les données d'un segment
+commencent alors par un octet de mode :
+	0 : le reste du segment est brut (bloc incompressible)
+	1 : le reste du segment est un bloc compressé avec l'algorithme négocié
+Le serveur essaie de mettre dans chaque segment le plus grand bloc du fichier
+dont la forme compressée tient dans le segment. */
+
+// algorithmes de compression connus, par ordre de préférence du serveur
+var algosCompression = []string{"deflate", "gzip"}
+
+const (
+	modeBrut      = 0
+	modeCompresse = 1
+	blocMax       = 64 * 1024 //plus grand bloc brut compressé dans un seul segment
+)
+
+// choisirCompression renvoie le premier algorithme de la liste du client que l'on connaît, "" sinon
+func choisirCompression(demande string) string {
+	for _, algo := range strings.Split(demande, ",") {
+		for _, connu := range algosCompression {
+			if algo == connu {
+				return algo
+			}
+		}
+	}
+	return ""
+}
+
+// segmenteur remplit la partie données des segments à partir du fichier
+type segmenteur interface {
+	// remplir écrit dans donnees les prochaines données à envoyer et renvoie leur taille, 0 à la fin du fichier
+	remplir(donnees []byte) (int, error)
+}
+
+// nouveauSegmenteur renvoie le segmenteur correspondant aux options négociées
+func nouveauSegmenteur(r io.Reader, opts options) segmenteur {
+	if algo := opts["compression"]; algo != "" {
+		s := &segmenteurCompresse{r: bufio.NewReaderSize(r, blocMax), algo: algo}
+		s.deflate, _ = flate.NewWriter(nil, flate.BestSpeed)
+		s.gzip, _ = gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return s
+	}
+	return segmenteurBrut{r}
+}
+
+// segmenteurBrut découpe le fichier tel quel, comme à l'origine
+type segmenteurBrut struct {
+	r io.Reader
+}
+
+func (s segmenteurBrut) remplir(donnees []byte) (int, error) {
+	n, err := io.ReadFull(s.r, donnees)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// segmenteurCompresse compresse des blocs du fichier qui tiennent chacun dans un segment
+type segmenteurCompresse struct {
+	r       *bufio.Reader
+	algo    string
+	bloc    int //taille brute visée pour le prochain bloc
+	tampon  bytes.Buffer
+	deflate *flate.Writer
+	gzip    *gzip.Writer
+}
+
+func (s *segmenteurCompresse) compresser(brut []byte) []byte {
+	s.tampon.Reset()
+	var w io.WriteCloser = s.deflate
+	if s.algo == "gzip" {
+		s.gzip.Reset(&s.tampon)
+		w = s.gzip
+	} else {
+		s.deflate.Reset(&s.tampon)
+	}
+	w.Write(brut)
+	w.Close()
+	return s.tampon.Bytes()
+}
+
+func (s *segmenteurCompresse) remplir(donnees []byte) (int, error) {
+	place := len(donnees) - 1
+	if s.bloc <= place {
+		s.bloc = 4 * place
+	}
+
+	//on cherche un bloc dont la version compressée tient dans le segment
+	for essai := 0; essai < 4 && s.bloc > place; essai++ {
+		brut, err := s.r.Peek(min(s.bloc, blocMax))
+		if len(brut) == 0 {
+			if err == io.EOF {
+				err = nil
+			}
+			return 0, err
+		}
+		compresse := s.compresser(brut)
+		if len(compresse) <= place {
+			donnees[0] = modeCompresse
+			copy(donnees[1:], compresse)
+			s.r.Discard(len(brut))
+			//le prochain bloc est dimensionné pour remplir le segment
+			s.bloc = len(brut) * place / len(compresse) * 95 / 100
+			return 1 + len(compresse), nil
+		}
+		s.bloc = len(brut) * place / len(compresse) * 9 / 10
+	}
+
+	//bloc incompressible : on l'envoie brut et on retentera au prochain segment
+	n, err := io.ReadFull(s.r, donnees[1:])
+	if n == 0 {
+		if err == io.EOF {
+			err = nil
+		}
+		return 0, err
+	}
+	donnees[0] = modeBrut
+	s.bloc = 2 * place
+	return 1 + n, nil
+}
+
+// decompresser renvoie les données brutes d'un segment compressé avec l'algorithme algo.
+// Un bloc ne dépasse jamais blocMax octets une fois décompressé : au-delà, le segment
+// vient d'un pair qui essaie de nous faire remplir la mémoire, on le refuse.
+func decompresser(algo string, donnees []byte) ([]byte, error) {
+	if len(donnees) == 0 {
+		return nil, fmt.Errorf("segment compressé vide")
+	}
+	if donnees[0] == modeBrut {
+		return donnees[1:], nil
+	}
+	var r io.Reader
+	switch algo {
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(donnees[1:]))
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(donnees[1:]))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	default:
+		return nil, fmt.Errorf("compression %q inconnue", algo)
+	}
+	brut, err := io.ReadAll(io.LimitReader(r, blocMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(brut) > blocMax {
+		return nil, fmt.Errorf("bloc décompressé de plus de %d octets", blocMax)
+	}
+	return brut, nil
+}
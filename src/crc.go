@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+/*-------------------------------------------------------------- */
+/*--------------------CONTROLE DES SEGMENTS (CRC)--------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "crc32c", l'en-tête d'un segment devient :
+	<numéro de séquence sur 6 chiffres><CRC32C sur 4 octets, big endian><données>
+Le CRC porte sur le numéro de séquence et les données. Un segment dont le CRC
+est faux est jeté par le récepteur, qui demande tout de suite son renvoi avec
+"NACK<numéro de séquence sur 6 chiffres>" au lieu d'attendre le timeout. */
+
+var tableCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// compteurs de segments corrompus depuis le lancement du programme
+var segmentsCorrompus atomic.Int64 // segments jetés par le récepteur (CRC faux)
+var nacksRecus atomic.Int64        // NACK reçus par l'émetteur
+
+// tailleEntete renvoie la taille de l'en-tête des segments de données
+func tailleEntete(opts options) int {
+	if opts.a("crc32c") {
+		return 6 + 4
+	}
+	return 6
+}
+
+// crcSegment calcule le CRC32C du numéro de séquence et des données d'un segment avec CRC
+func crcSegment(paquet []byte) uint32 {
+	crc := crc32.Update(0, tableCRC, paquet[0:6])
+	return crc32.Update(crc, tableCRC, paquet[10:])
+}
+
+// sceller écrit le CRC dans l'en-tête d'un segment déjà rempli
+func sceller(paquet []byte) {
+	binary.BigEndian.PutUint32(paquet[6:10], crcSegment(paquet))
+}
+
+// verifierSegment indique si le CRC d'un segment reçu correspond à son contenu
+func verifierSegment(paquet []byte) bool {
+	return len(paquet) >= 10 && binary.BigEndian.Uint32(paquet[6:10]) == crcSegment(paquet)
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*-------------------------LES CAPTURES------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Le décodeur lit une capture pcap ou pcapng (celle de -capture, ou de
+tcpdump sur l'interface loopback, Ethernet ou « any ») et n'en garde que les
+datagrammes UDP, ou une trace écrite avec -trace. */
+
+// datagrammeCapture est un datagramme UDP de la capture
+type datagrammeCapture struct {
+	date   time.Time
+	src    netip.AddrPort
+	dst    netip.AddrPort
+	charge []byte
+}
+
+// lireCapture reconnaît le format du fichier et en extrait les datagrammes UDP
+func lireCapture(contenu []byte) ([]datagrammeCapture, error) {
+	if len(contenu) < 24 {
+		return nil, errors.New("fichier trop court pour une capture")
+	}
+	switch {
+	case binary.LittleEndian.Uint32(contenu) == 0x0A0D0D0A:
+		return lirePcapng(contenu)
+	default:
+		return lirePcap(contenu)
+	}
+}
+
+// lirePcap lit une capture pcap classique (microsecondes ou nanosecondes, dans les deux ordres d'octets)
+func lirePcap(contenu []byte) ([]datagrammeCapture, error) {
+	var ordre binary.ByteOrder
+	var unite time.Duration
+	switch binary.LittleEndian.Uint32(contenu) {
+	case 0xA1B2C3D4:
+		ordre, unite = binary.LittleEndian, time.Microsecond
+	case 0xD4C3B2A1:
+		ordre, unite = binary.BigEndian, time.Microsecond
+	case 0xA1B23C4D:
+		ordre, unite = binary.LittleEndian, time.Nanosecond
+	case 0x4D3CB2A1:
+		ordre, unite = binary.BigEndian, time.Nanosecond
+	default:
+		return nil, errors.New("ni pcap, ni pcapng")
+	}
+	lien := ordre.Uint32(contenu[20:]) & 0xFFFF
+	var datagrammes []datagrammeCapture
+	for o := 24; o+16 <= len(contenu); {
+		secondes, fraction, longueur := ordre.Uint32(contenu[o:]), ordre.Uint32(contenu[o+4:]), int(ordre.Uint32(contenu[o+8:]))
+		o += 16
+		if o+longueur > len(contenu) {
+			return datagrammes, errors.New("capture tronquée")
+		}
+		date := time.Unix(int64(secondes), int64(fraction)*int64(unite))
+		if d, ok := extraireUDP(lien, contenu[o:o+longueur], date); ok {
+			datagrammes = append(datagrammes, d)
+		}
+		o += longueur
+	}
+	return datagrammes, nil
+}
+
+// interfacePcapng est ce qu'on garde de la description d'une interface
+type interfacePcapng struct {
+	lien       uint32
+	snapLen    int
+	resolution float64 // secondes par unité d'horodatage
+}
+
+// lirePcapng lit une capture pcapng (plusieurs sections et interfaces possibles)
+func lirePcapng(contenu []byte) ([]datagrammeCapture, error) {
+	var ordre binary.ByteOrder = binary.LittleEndian
+	var interfaces []interfacePcapng
+	var datagrammes []datagrammeCapture
+	for o := 0; o+12 <= len(contenu); {
+		genre := ordre.Uint32(contenu[o:])
+		if genre == blocSection {
+			//l'ordre des octets est donné par chaque en-tête de section
+			if binary.BigEndian.Uint32(contenu[o+8:]) == 0x1A2B3C4D {
+				ordre = binary.BigEndian
+			} else {
+				ordre = binary.LittleEndian
+			}
+			interfaces = nil
+		}
+		longueur := int(ordre.Uint32(contenu[o+4:]))
+		if longueur < 12 || o+longueur > len(contenu) {
+			return datagrammes, errors.New("capture tronquée")
+		}
+		corps := contenu[o+8 : o+longueur-4]
+		o += longueur
+
+		switch genre {
+		case blocInterface:
+			if len(corps) < 8 {
+				continue
+			}
+			i := interfacePcapng{lien: uint32(ordre.Uint16(corps)), snapLen: int(ordre.Uint32(corps[4:])), resolution: 1e-6}
+			//options : seule if_tsresol (code 9) nous intéresse
+			for p := 8; p+4 <= len(corps); {
+				code, l := ordre.Uint16(corps[p:]), int(ordre.Uint16(corps[p+2:]))
+				if code == 0 || p+4+l > len(corps) {
+					break
+				}
+				if code == 9 && l >= 1 {
+					if v := corps[p+4]; v&0x80 == 0 {
+						i.resolution = math.Pow(10, -float64(v))
+					} else {
+						i.resolution = math.Pow(2, -float64(v&0x7F))
+					}
+				}
+				p += 4 + (l+3)/4*4
+			}
+			interfaces = append(interfaces, i)
+		case blocPaquet:
+			if len(corps) < 20 {
+				continue
+			}
+			numero, longueurCapture := int(ordre.Uint32(corps)), int(ordre.Uint32(corps[12:]))
+			if numero >= len(interfaces) || 20+longueurCapture > len(corps) {
+				continue
+			}
+			i := interfaces[numero]
+			horodatage := uint64(ordre.Uint32(corps[4:]))<<32 | uint64(ordre.Uint32(corps[8:]))
+			date := time.Unix(0, 0).Add(time.Duration(float64(horodatage) * i.resolution * 1e9))
+			if d, ok := extraireUDP(i.lien, corps[20:20+longueurCapture], date); ok {
+				datagrammes = append(datagrammes, d)
+			}
+		case 3: //bloc de paquet simple : pas de date, interface 0
+			if len(corps) < 4 || len(interfaces) == 0 {
+				continue
+			}
+			l := min(int(ordre.Uint32(corps)), len(corps)-4)
+			if interfaces[0].snapLen > 0 {
+				l = min(l, interfaces[0].snapLen)
+			}
+			if d, ok := extraireUDP(interfaces[0].lien, corps[4:4+l], time.Time{}); ok {
+				datagrammes = append(datagrammes, d)
+			}
+		}
+	}
+	return datagrammes, nil
+}
+
+// extraireUDP retire l'en-tête du lien, puis IP et UDP ; ok est faux pour tout autre paquet
+func extraireUDP(lien uint32, trame []byte, date time.Time) (datagrammeCapture, bool) {
+	var ip []byte
+	switch lien {
+	case lienRaw, 12, 14, 228, 229:
+		ip = trame
+	case 0: //loopback BSD : famille d'adresse sur 4 octets
+		if len(trame) < 4 {
+			return datagrammeCapture{}, false
+		}
+		ip = trame[4:]
+	case 1: //Ethernet, éventuellement avec une étiquette de VLAN
+		if len(trame) < 14 {
+			return datagrammeCapture{}, false
+		}
+		genre, o := binary.BigEndian.Uint16(trame[12:]), 14
+		if genre == 0x8100 && len(trame) >= 18 {
+			genre, o = binary.BigEndian.Uint16(trame[16:]), 18
+		}
+		if genre != 0x0800 && genre != 0x86DD {
+			return datagrammeCapture{}, false
+		}
+		ip = trame[o:]
+	case 113: //Linux « cooked » (tcpdump -i any)
+		if len(trame) < 16 {
+			return datagrammeCapture{}, false
+		}
+		ip = trame[16:]
+	case 276: //Linux « cooked » v2
+		if len(trame) < 20 {
+			return datagrammeCapture{}, false
+		}
+		ip = trame[20:]
+	default:
+		return datagrammeCapture{}, false
+	}
+	if len(ip) < 1 {
+		return datagrammeCapture{}, false
+	}
+
+	var src, dst netip.Addr
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return datagrammeCapture{}, false
+		}
+		entete := int(ip[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:]))
+		fragment := binary.BigEndian.Uint16(ip[6:])
+		//un fragment ne porte pas un datagrammeCapture entier : on l'ignore
+		if ip[9] != 17 || fragment&0x3FFF != 0 || entete < 20 || total > len(ip) || entete > total {
+			return datagrammeCapture{}, false
+		}
+		src, _ = netip.AddrFromSlice(ip[12:16])
+		dst, _ = netip.AddrFromSlice(ip[16:20])
+		udp = ip[entete:total]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 {
+			return datagrammeCapture{}, false
+		}
+		charge := int(binary.BigEndian.Uint16(ip[4:]))
+		if 40+charge > len(ip) {
+			return datagrammeCapture{}, false
+		}
+		src, _ = netip.AddrFromSlice(ip[8:24])
+		dst, _ = netip.AddrFromSlice(ip[24:40])
+		udp = ip[40 : 40+charge]
+	default:
+		return datagrammeCapture{}, false
+	}
+	if len(udp) < 8 {
+		return datagrammeCapture{}, false
+	}
+	longueur := int(binary.BigEndian.Uint16(udp[4:]))
+	if longueur < 8 || longueur > len(udp) {
+		return datagrammeCapture{}, false
+	}
+	return datagrammeCapture{
+		date:   date,
+		src:    netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(udp)),
+		dst:    netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(udp[2:])),
+		charge: udp[8:longueur],
+	}, true
+}
+
+/*-------------------------------------------------------------- */
+/*----------------------ANALYSE DES ENVOIS---------------------- */
+/*-------------------------------------------------------------- */
+
+// voie désigne les segments d'un sens de la connexion (et d'un flux)
+type voie struct {
+	duClient bool
+	flux     int
+}
+
+// analyseVoie compte les segments et les ACK d'une voie
+type analyseVoie struct {
+	vus         map[int]int // nombre de fois que chaque segment a été vu
+	premier     int
+	plusHaut    int
+	segments    int
+	octets      int
+	renvois     int
+	horsOrdre   int
+	acks        int
+	dupliques   int
+	dernierACK  int
+	plusHautACK int
+	acksRetard  int // ACK plus petit qu'un ACK déjà vu
+	nacks       int
+	pertes      map[string]int // segments déclarés perdus (trace), par déclencheur
+}
+
+// analyse regroupe les voies d'une connexion
+type analyse struct {
+	voies map[voie]*analyseVoie
+	ordre []voie
+}
+
+func (a *analyse) voie(v voie) *analyseVoie {
+	if a.voies == nil {
+		a.voies = make(map[voie]*analyseVoie)
+	}
+	av, ok := a.voies[v]
+	if !ok {
+		av = &analyseVoie{vus: make(map[int]int), dernierACK: -1, plusHautACK: -1, pertes: make(map[string]int)}
+		a.voies[v] = av
+		a.ordre = append(a.ordre, v)
+	}
+	return av
+}
+
+// segment note un segment de données ; renvoi est connu dans une trace, deviné sinon
+func (av *analyseVoie) segment(seq, taille int, renvoi bool) string {
+	if av.segments == 0 || seq < av.premier {
+		av.premier = seq
+	}
+	av.segments++
+	av.octets += taille
+	av.vus[seq]++
+	switch {
+	case av.vus[seq] > 1 || renvoi:
+		av.renvois++
+		return " [renvoi]"
+	case seq < av.plusHaut:
+		av.horsOrdre++
+		return " [hors d'ordre]"
+	}
+	av.plusHaut = seq
+	return ""
+}
+
+// ack note un ACK du destinataire de la voie
+func (av *analyseVoie) ack(seq int) string {
+	av.acks++
+	note := ""
+	switch {
+	case seq == av.dernierACK:
+		av.dupliques++
+		note = " [dupliqué]"
+	case seq < av.plusHautACK:
+		av.acksRetard++
+		note = " [en retard]"
+	}
+	av.dernierACK = seq
+	av.plusHautACK = max(av.plusHautACK, seq)
+	return note
+}
+
+// resume décrit la voie en quelques lignes
+func (av *analyseVoie) resume() []string {
+	var lignes []string
+	if av.segments > 0 {
+		distincts := len(av.vus)
+		renvoyes := 0
+		for _, n := range av.vus {
+			if n > 1 {
+				renvoyes++
+			}
+		}
+		trous := 0
+		for s := av.premier; s <= av.plusHaut; s++ {
+			if av.vus[s] == 0 {
+				trous++
+			}
+		}
+		lignes = append(lignes, fmt.Sprintf("segments : %d (%d octets), %d distincts, %d..%d", av.segments, av.octets, distincts, av.premier, av.plusHaut))
+		lignes = append(lignes, fmt.Sprintf("renvois : %d (%d segments renvoyés au moins une fois), hors d'ordre : %d, jamais vus : %d", av.renvois, renvoyes, av.horsOrdre, trous))
+	}
+	if len(av.pertes) > 0 {
+		var declencheurs []string
+		for d, n := range av.pertes {
+			declencheurs = append(declencheurs, fmt.Sprintf("%d par %s", n, d))
+		}
+		slices.Sort(declencheurs)
+		lignes = append(lignes, "pertes déclarées : "+strings.Join(declencheurs, ", "))
+	}
+	if av.acks > 0 || av.nacks > 0 {
+		lignes = append(lignes, fmt.Sprintf("ACK : %d (%d dupliqués, %d en retard), NACK : %d", av.acks, av.dupliques, av.acksRetard, av.nacks))
+	}
+	return lignes
+}
+
+// afficher écrit le résumé de chaque voie
+func (a *analyse) afficher(nomSens func(duClient bool) string) {
+	for _, v := range a.ordre {
+		lignes := a.voies[v].resume()
+		if len(lignes) == 0 {
+			continue
+		}
+		titre := nomSens(v.duClient)
+		if v.flux > 0 {
+			titre += fmt.Sprintf(", flux %d", v.flux)
+		}
+		fmt.Println("  " + titre + " :")
+		for _, l := range lignes {
+			fmt.Println("    " + l)
+		}
+	}
+}
+
+/*-------------------------------------------------------------- */
+/*---------------------DECODAGE DES MESSAGES-------------------- */
+/*-------------------------------------------------------------- */
+
+// echange est une connexion retrouvée dans la capture
+type echange struct {
+	numero    int
+	client    netip.AddrPort
+	serveur   netip.AddrPort // port d'écoute
+	donnees   netip.AddrPort // port de données annoncé dans le SYN-ACK
+	options   options
+	handshake bool // le SYN a été capturé
+	lance     bool // des datagrammes sont passés par le port de données
+	debut     time.Time
+	lignes    []string
+	analyse   analyse
+}
+
+// sixChiffres lit un nombre sur 6 chiffres au début de b
+func sixChiffres(b []byte) (int, bool) {
+	if len(b) < 6 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(b[:6]))
+	return n, err == nil && b[0] >= '0' && b[0] <= '9'
+}
+
+// lisible renvoie un message de contrôle affichable, raccourci s'il est long
+func lisible(b []byte) string {
+	s := strconv.QuoteToGraphic(nettoyer(b))
+	s = s[1 : len(s)-1]
+	if len(s) > 100 {
+		s = s[:100] + "..."
+	}
+	return s
+}
+
+// sansRembourrage retire le rembourrage du SYN ("pad=000...")
+func sansRembourrage(s string) string {
+	champs := strings.Fields(s)
+	champs = slices.DeleteFunc(champs, func(c string) bool { return strings.HasPrefix(c, "pad=") })
+	return strings.Join(champs, " ")
+}
+
+// decoder décrit un datagrammeCapture de l'échange et met l'analyse à jour
+func (e *echange) decoder(d datagrammeCapture) string {
+	duClient := d.src == e.client
+	m := d.charge
+
+	//sur le port d'écoute : handshake en clair
+	if d.src == e.serveur || d.dst == e.serveur {
+		texte := nettoyer(m)
+		switch {
+		case strings.HasPrefix(texte, "SYN-ACK"):
+			champs := strings.Fields(texte)
+			port, err := strconv.Atoi(strings.TrimPrefix(champs[0], "SYN-ACK"))
+			if err == nil {
+				e.donnees = netip.AddrPortFrom(d.src.Addr(), uint16(port))
+				e.options = lireOptions(champs[1:])
+			}
+			return strings.TrimSpace("SYN-ACK port=" + strconv.Itoa(port) + " " + strings.Join(champs[1:], " "))
+		case strings.HasPrefix(texte, "SYN"):
+			return sansRembourrage(texte)
+		case strings.HasPrefix(texte, "ACK"):
+			return strings.TrimSpace("ACK (handshake) " + strings.TrimPrefix(texte, "ACK"))
+		}
+		return lisible(m)
+	}
+
+	//sur le port de données : chiffré, ou <flux><message>
+	e.lance = true
+	if e.options.a("aead") {
+		return fmt.Sprintf("chiffré (%d octets)", len(m))
+	}
+	flux := 0
+	if e.options.a("flux") && len(m) >= enteteFlux {
+		n, err := strconv.Atoi(string(m[:enteteFlux]))
+		if err == nil {
+			flux, m = n, m[enteteFlux:]
+		}
+	}
+	prefixe := ""
+	if flux > 0 {
+		prefixe = fmt.Sprintf("[flux %d] ", flux)
+	} else if e.options.a("flux") {
+		prefixe = "[contrôle] "
+	}
+	//les segments vont de l'émetteur au destinataire, les ACK en sens inverse
+	emis := e.analyse.voie(voie{duClient: duClient, flux: flux})
+	recu := e.analyse.voie(voie{duClient: !duClient, flux: flux})
+	texte := nettoyer(m)
+
+	if seq, ok := sixChiffres(m); ok {
+		taille := len(m) - tailleEntete(e.options)
+		return prefixe + fmt.Sprintf("DATA seq=%d (%d octets)", seq, taille) + emis.segment(seq, taille, false)
+	}
+	switch {
+	case strings.HasPrefix(texte, "ACKPMTU"):
+		taille, _ := sixChiffres(m[7:])
+		return prefixe + fmt.Sprintf("ACKPMTU taille=%d", taille)
+	case strings.HasPrefix(texte, "ACK") && len(m) >= 9:
+		seq, ok := sixChiffres(m[3:])
+		if ok {
+			reste := strings.TrimSpace(texte[9:])
+			return prefixe + strings.TrimSpace(fmt.Sprintf("ACK seq=%d %s", seq, reste)) + recu.ack(seq)
+		}
+	case strings.HasPrefix(texte, "NACK"):
+		seq, _ := sixChiffres(m[4:])
+		recu.nacks++
+		return prefixe + fmt.Sprintf("NACK seq=%d", seq)
+	case strings.HasPrefix(texte, "PMTU"):
+		taille, _ := sixChiffres(m[4:])
+		return prefixe + fmt.Sprintf("PMTU sonde taille=%d", taille)
+	case strings.HasPrefix(texte, "FEC") && len(m) >= 13:
+		premier, _ := sixChiffres(m[3:])
+		nombre, _ := strconv.Atoi(string(m[9:11]))
+		rang, _ := strconv.Atoi(string(m[11:13]))
+		return prefixe + fmt.Sprintf("FEC parité %d des segments %d..%d", rang, premier, premier+nombre-1)
+	case strings.HasPrefix(texte, "META"), strings.HasPrefix(texte, "FIN"), strings.HasPrefix(texte, "DENY"),
+		strings.HasPrefix(texte, "BUSY"), strings.HasPrefix(texte, "PRET"), texte == "CLOSE":
+		return prefixe + lisible(m)
+	}
+	if duClient && len(m) > 0 && m[len(m)-1] == 0 {
+		//demande du client : "<nom>\0", ou une commande (GET, PUT, LIST, STAT)
+		r, ok := lireRequeteTexte(texte)
+		if ok {
+			return prefixe + strings.TrimSpace(r.commande+" "+r.nom)
+		}
+	}
+	return prefixe + fmt.Sprintf("? %q (%d octets)", lisible(m[:min(len(m), 16)]), len(m))
+}
+
+// lireRequeteTexte décode la demande d'un client, avec ou sans numéro de session
+func lireRequeteTexte(texte string) (requete, bool) {
+	champs := strings.SplitN(texte, " ", 3)
+	if _, ok := commandes[champs[0]]; ok && len(champs) >= 2 {
+		//en session : "GET <numéro> <nom>"
+		if len(champs) == 3 {
+			if _, err := strconv.Atoi(champs[1]); err == nil {
+				return requete{commande: champs[0], nom: champs[2]}, true
+			}
+		}
+		return requete{commande: champs[0], nom: strings.Join(champs[1:], " ")}, true
+	}
+	if strings.ContainsFunc(texte, func(r rune) bool { return r < ' ' }) {
+		return requete{}, false
+	}
+	return requete{commande: "GET", nom: texte}, true
+}
+
+// decoderCapture répartit les datagrammes en échanges et les décode
+func decoderCapture(datagrammes []datagrammeCapture) []*echange {
+	var echanges []*echange
+	parClient := make(map[netip.AddrPort]*echange)
+	trouver := func(d datagrammeCapture) *echange {
+		if e, ok := parClient[d.src]; ok {
+			return e
+		}
+		if e, ok := parClient[d.dst]; ok {
+			return e
+		}
+		return nil
+	}
+	for _, d := range datagrammes {
+		e := trouver(d)
+		texte := nettoyer(d.charge)
+		if e == nil || (strings.HasPrefix(texte, "SYN") && !strings.HasPrefix(texte, "SYN-ACK") && d.src == e.client && e.lance) {
+			//nouveau client (ou nouvelle connexion depuis la même socket) : il a commencé par un SYN,
+			//sinon la capture a commencé en route et on prend l'émetteur pour le client
+			e = &echange{numero: len(echanges) + 1, client: d.src, serveur: d.dst, options: make(options), debut: d.date}
+			e.handshake = strings.HasPrefix(texte, "SYN") && !strings.HasPrefix(texte, "SYN-ACK")
+			if !e.handshake {
+				e.serveur = netip.AddrPort{} //inconnu : tout est décodé comme sur le port de données
+			}
+			echanges = append(echanges, e)
+			parClient[d.src] = e
+		}
+		sens := "serveur -> client"
+		if d.src == e.client {
+			sens = "client -> serveur"
+		}
+		e.lignes = append(e.lignes, fmt.Sprintf("%10.3f  %s  %s", d.date.Sub(e.debut).Seconds()*1000, sens, e.decoder(d)))
+	}
+	return echanges
+}
+
+/*-------------------------------------------------------------- */
+/*---------------------DECODAGE DES TRACES---------------------- */
+/*-------------------------------------------------------------- */
+
+// decoderTrace décrit chaque événement d'une trace de -trace et analyse l'envoi
+func decoderTrace(contenu []byte, silence bool) error {
+	lecteur := bufio.NewScanner(bytes.NewReader(contenu))
+	lecteur.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !lecteur.Scan() {
+		return errors.New("trace vide")
+	}
+	var entete enteteTrace
+	if err := json.Unmarshal(lecteur.Bytes(), &entete); err != nil || entete.Format != "JSON-SEQ" {
+		return errors.New("ni une capture, ni une trace")
+	}
+	fmt.Printf("trace de %s (%s), %s\n", entete.Titre, entete.Trace.Point.Type, time.UnixMilli(entete.Trace.Communs.Reference).Format(time.DateTime))
+
+	var a analyse
+	nombre := func(e evenement, nom string) int {
+		v, _ := e.Data[nom].(float64)
+		return int(v)
+	}
+	for lecteur.Scan() {
+		var e evenement
+		if err := json.Unmarshal(lecteur.Bytes(), &e); err != nil {
+			return err
+		}
+		flux := nombre(e, "flux")
+		av := a.voie(voie{duClient: entete.Trace.Point.Type == "client", flux: flux})
+		var ligne string
+		switch e.Nom {
+		case "transfer:start":
+			ligne = fmt.Sprintf("début de %v (%d octets, %d segments au plus de %d octets)", e.Data["fichier"], nombre(e, "taille"), nombre(e, "segments"), nombre(e, "chunk"))
+		case "transport:packet_sent":
+			renvoi, _ := e.Data["renvoi"].(bool)
+			ligne = fmt.Sprintf("DATA seq=%d (%d octets)", nombre(e, "seq"), nombre(e, "taille")) + av.segment(nombre(e, "seq"), nombre(e, "taille"), renvoi)
+		case "transport:packet_received":
+			switch e.Data["type"] {
+			case "ACK":
+				ligne = fmt.Sprintf("ACK seq=%d", nombre(e, "seq"))
+				if _, ok := e.Data["rwnd"]; ok {
+					ligne += fmt.Sprintf(" rwnd=%d", nombre(e, "rwnd"))
+				}
+				ligne += av.ack(nombre(e, "seq"))
+			case "NACK":
+				av.nacks++
+				ligne = fmt.Sprintf("NACK seq=%d", nombre(e, "seq"))
+			default:
+				ligne = fmt.Sprintf("%v taille=%d", e.Data["type"], nombre(e, "taille"))
+			}
+		case "recovery:packet_lost":
+			declencheur, _ := e.Data["declencheur"].(string)
+			av.pertes[declencheur]++
+			ligne = fmt.Sprintf("perte seq=%d (%s)", nombre(e, "seq"), declencheur)
+		case "recovery:metrics_updated":
+			ligne = fmt.Sprintf("fenêtre %d..%d, prochain %d, acquitté %d, en vol %d, rwnd %d",
+				nombre(e, "borne_inf"), nombre(e, "borne_sup"), nombre(e, "prochain"), nombre(e, "acquitte"), nombre(e, "en_vol"), nombre(e, "rwnd"))
+		case "transport:fin_sent":
+			ligne = fmt.Sprintf("FIN après le segment %d", nombre(e, "seq"))
+		default:
+			ligne = e.Nom
+		}
+		if flux > 0 {
+			ligne = fmt.Sprintf("[flux %d] ", flux) + ligne
+		}
+		if !silence {
+			fmt.Printf("%10.3f  %s\n", e.Temps, ligne)
+		}
+	}
+	if err := lecteur.Err(); err != nil {
+		return err
+	}
+	fmt.Println("résumé :")
+	a.afficher(func(bool) string { return "envoi" })
+	return nil
+}
+
+/*-------------------------------------------------------------- */
+/*-----------------------------MAIN----------------------------- */
+/*-------------------------------------------------------------- */
+
+func main() {
+	silence := flag.Bool("q", false, "n'afficher que le résumé de chaque connexion")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage : ./decodeur [-q] <capture.pcap | capture.pcapng | trace.qlog>")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	contenu, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	//une trace commence par un objet JSON, une capture par un nombre magique
+	if bytes.HasPrefix(bytes.TrimSpace(contenu), []byte("{")) {
+		if err := decoderTrace(contenu, *silence); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	datagrammes, err := lireCapture(contenu)
+	if err != nil && len(datagrammes) == 0 {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, e := range decoderCapture(datagrammes) {
+		titre := fmt.Sprintf("connexion %d : client %s", e.numero, e.client)
+		if e.serveur.IsValid() {
+			titre += fmt.Sprintf(", serveur %s", e.serveur)
+		}
+		if e.donnees.IsValid() {
+			titre += fmt.Sprintf(", données sur le port %d", e.donnees.Port())
+		}
+		if !e.handshake {
+			titre += " (sans handshake : commencée avant la capture)"
+		}
+		fmt.Println(titre)
+		if !*silence {
+			for _, l := range e.lignes {
+				fmt.Println(l)
+			}
+		}
+		fmt.Println("résumé :")
+		e.analyse.afficher(func(duClient bool) string {
+			if duClient {
+				return "client -> serveur"
+			}
+			return "serveur -> client"
+		})
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err) //capture tronquée : on a décodé ce qui précède
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*----------------------DEPOT DE FICHIERS (PUT)----------------- */
+/*-------------------------------------------------------------- */
+
+/* Si le serveur est lancé avec -depot, un client peut demander l'option "put"
+et lui envoyer un fichier au lieu d'en télécharger un. Les rôles sont alors
+inversés sur le port de données :
+	client  -> "PUT <nom>\0"
+	serveur -> "PRET" (ou "DENY <raison>"), répété tant que rien n'arrive
+	client  -> META, segments, FIN, comme le serveur pour un téléchargement
+	serveur -> ACK, NACK, comme le client
+	serveur -> "FIN-ACK" une fois le fichier en place, "DENY <raison>" sinon
+Le fichier est écrit dans un fichier temporaire du même dossier, puis lié sous
+son nom définitif seulement s'il est arrivé en entier (et intact avec "sha256") :
+un fichier servi n'est jamais à moitié écrit. Un dépôt ne remplace jamais un
+fichier qui existe déjà, et ne peut dépasser -depotMax octets (la taille
+annoncée par META comme ce qui arrive vraiment). Le client répète son FIN tant
+qu'il n'a pas reçu la réponse. Un client authentifié ne peut déposer que là où
+son identité a des droits. */
+
+// réglages de l'envoi pour les dépôts du client Go (ceux de serveur1)
+var reglagesDepot = reglagesEmission{winSize: 75, timeout: time.Millisecond * 150}
+
+// recevoirDepot reçoit le fichier envoyé par le client et le met en place sous le nom demandé
+func recevoirDepot(c *connexion, nom string) error {
+	nom = nettoyerChemin(nom)
+	if nom == "" || nom == "*" {
+		return fmt.Errorf("nom de fichier invalide")
+	}
+	//un fichier servi n'est jamais remplacé par un dépôt : inutile de recevoir celui-ci
+	if _, err := c.racine.Stat(nom); err == nil {
+		return fmt.Errorf("%s existe déjà", nom)
+	}
+	temporaire := path.Join(path.Dir(nom), "."+path.Base(nom)+"."+nouveauNonce()[:8]+".part")
+	sortie, err := c.racine.OpenFile(temporaire, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = recevoir(c, sortie, []byte("PRET"), reglagesReception{max: c.depotMax})
+	if errClose := sortie.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		//contrairement à Rename, Link échoue si le nom est pris entre-temps
+		//(par un autre dépôt du même nom qui s'est terminé pendant celui-ci)
+		err = c.racine.Link(temporaire, nom)
+		if errors.Is(err, fs.ErrExist) {
+			err = fmt.Errorf("%s existe déjà", nom)
+		}
+	}
+	c.racine.Remove(temporaire)
+	return err
+}
+
+// confirmerDepot envoie le résultat du dépôt et le renvoie tant que le client répète son FIN
+func confirmerDepot(c *connexion, resultat error) {
+	reponse := []byte("FIN-ACK")
+	if resultat != nil {
+		reponse = []byte("DENY " + resultat.Error())
+	}
+	buf := make([]byte, 1500) //le FIN répété porte l'empreinte, et il est chiffré avec -psk
+	defer c.conn.SetReadDeadline(time.Time{})
+	for essai := 0; essai < essaisControle; essai++ {
+		if _, err := c.conn.WriteTo(reponse, c.addr); err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(c.temps().maintenant().Add(delaiControle))
+		for {
+			n, from, err := c.conn.ReadFrom(buf)
+			if err != nil {
+				return //le client ne répète plus son FIN : il a eu la réponse
+			}
+			if memeAdresse(from, c.addr) && strings.HasPrefix(nettoyer(buf[:n]), "FIN") {
+				break
+			}
+		}
+	}
+}
+
+// deposer envoie le fichier local t.fichier au serveur, qui l'enregistre sous le nom t.sortie
+func deposer(t telechargement) error {
+	fichier, err := os.Open(t.fichier)
+	if err != nil {
+		return err
+	}
+	defer fichier.Close()
+
+	t.options = maps.Clone(t.options)
+	t.options["put"] = ""
+	conn, dataConn, serveur, opts, err := connecter(t)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !opts.a("put") {
+		return fmt.Errorf("le serveur n'accepte pas les dépôts")
+	}
+	c := &connexion{conn: dataConn, addr: serveur, options: opts}
+	if t.trace != "" {
+		if c.trace, err = ouvrirTrace(t.trace, "client", dataConn.LocalAddr(), serveur, c.temps()); err != nil {
+			return err
+		}
+		defer c.trace.fermer()
+	}
+
+	//on attend que le serveur soit prêt à recevoir
+	demande := append([]byte("PUT "+t.sortie), 0)
+	if err := attendreReponse(c, demande, "PRET"); err != nil {
+		return err
+	}
+
+	stats := nouvellesStatistiques(t.fichier, serveur, c.temps())
+	fin, err := envoyer(c, fichier, t.fichier, reglagesDepot, stats)
+	if err != nil {
+		return err
+	}
+	//le serveur confirme une fois le fichier en place ; s'il n'a pas eu le FIN, on le répète
+	if err := attendreReponse(c, fin, "FIN-ACK"); err != nil {
+		return err
+	}
+	stats.afficher(t.stats)
+	return nil
+}
+
+// attendreReponse envoie message jusqu'à recevoir attendue (ou DENY) de la part de c.addr
+func attendreReponse(c *connexion, message []byte, attendue string) error {
+	buf := make([]byte, 1024)
+	defer c.conn.SetReadDeadline(time.Time{})
+	for essai := 0; essai < essaisControle; essai++ {
+		if _, err := c.conn.WriteTo(message, c.addr); err != nil {
+			return err
+		}
+		c.conn.SetReadDeadline(c.temps().maintenant().Add(delaiControle))
+		for {
+			n, from, err := c.conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return err
+			}
+			if !memeAdresse(from, c.addr) {
+				continue
+			}
+			reponse := nettoyer(buf[:n])
+			if reponse == attendue {
+				return nil
+			}
+			if raison, ok := strings.CutPrefix(reponse, "DENY "); ok {
+				return fmt.Errorf("refusé par le serveur : %s", raison)
+			}
+		}
+	}
+	return fmt.Errorf("pas de %s de %v", attendue, c.addr)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*----------------------ENVOI D'UN FICHIER---------------------- */
+/*-------------------------------------------------------------- */
+
+/* Moteur d'envoi à fenêtre glissante : il sert aux serveurs pour les
+téléchargements et au client Go pour les dépôts ("PUT"). Chaque scénario de
+serveur a ses propres réglages. */
+
+// reglagesEmission sont les paramètres de l'envoi propres à chaque scénario
+type reglagesEmission struct {
+	winSize int           // taille de la fenêtre d'envoi, en segments
+	timeout time.Duration // délai avant de renvoyer le premier segment non acquitté
+}
+
+func getSeq(ack string) (seq int) {
+	fmt.Sscanf(ack, "%06d", &seq)
+	return seq
+}
+
+// source est ce qu'envoie envoyer : un fichier ouvert ou un document construit par le serveur
+type source interface {
+	io.ReadSeeker
+	Stat() (fs.FileInfo, error)
+}
+
+// envoyer envoie le fichier au destinataire c.addr (fileName ne sert qu'aux messages)
+// et renvoie le FIN qui lui a été envoyé une fois tout acquitté ; stats se remplit au fil de l'envoi
+func envoyer(c *connexion, file source, fileName string, reglages reglagesEmission, stats *statistiques) ([]byte, error) {
+	//On cherche la taille du fichier
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	j := c.log().With("fichier", fileName)
+	j.Debug("début de l'envoi", "taille", fi.Size(), "options", c.options.String())
+
+	//taille de l'en-tête : numéro de séquence sur 6 chiffres (+ CRC si le client l'a demandé)
+	entete := tailleEntete(c.options)
+
+	//chunk de données des premiers segments (1500 octets max par paquet, chiffrement compris,
+	//ou la taille négociée) : les segments suivants ne sont jamais plus petits
+	chunkSize := tailleInitiale(c.options) - surcoutDatagramme(c.options) - entete
+
+	nbseg := int(fi.Size()) / chunkSize
+	if nbseg*chunkSize < int(fi.Size()) {
+		nbseg = nbseg + 1
+	}
+	//avec la compression (octet de mode) ou des segments qui grandissent, nbseg n'est qu'un maximum
+	if c.options.a("compression") {
+		nbseg = int(fi.Size())/(chunkSize-1) + 1
+	}
+
+	//empreinte du fichier, calculée avant l'envoi si le client l'a demandée
+	empreinte := nouvelleEmpreinte(c.options)
+	if empreinte != nil {
+		if _, err := io.Copy(empreinte, file); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	//découpage brut, ou compressé si le client l'a demandé, au fil de l'envoi pour
+	//suivre la taille des segments
+	decoupe := nouveauDecoupage(file, c.options, c.base)
+
+	//en session, les numéros continuent ceux des transferts précédents
+	if c.base+nbseg > seqMax {
+		return nil, fmt.Errorf("session trop longue pour %s : ouvrez-en une nouvelle", fileName)
+	}
+	c.trace.debutEnvoi(fileName, fi.Size(), nbseg, chunkSize)
+
+	//Si le client l'a demandé, on lui annonce ce qu'il va recevoir avant le premier segment
+	if c.options.a("meta") {
+		meta := metadonnees{taille: fi.Size(), segments: nbseg, chunk: chunkSize, mtime: fi.ModTime(), empreinte: formaterEmpreinte(empreinte)}
+		if err := envoyerMetadonnees(c, meta); err != nil {
+			return nil, err
+		}
+	}
+
+	//Si le client l'a demandé, on cherche la plus grande taille de segment qui passe
+	var sondes *sondeur
+	if c.options.a("pmtud") {
+		sondes = nouveauSondeur(c, decoupe)
+		sondes.lancer()
+		defer sondes.arreter()
+	}
+
+	//création de nos variables
+	//la goroutine d'envoi numérote à partir de sa propre copie de la base
+	base := c.base
+	//l'état de la fenêtre est partagé par la goroutine d'envoi et la boucle des ACK :
+	//chacune le modifie sous mu
+	var mu sync.Mutex
+	var fin []byte                         //FIN envoyé une fois tout acquitté
+	timeouts := make([]time.Time, nbseg+2) //+2 sinon index out of range
+	buf := make([]byte, 1024)              //assez pour la raison d'un DENY
+	next_seq := 1
+	last_ack := 0
+	same_ack := 0
+	lost_ack := false
+	borneInfSlide := false
+	borneInf := 1
+	borneSup := 0
+	next_biggest_ack := last_ack + 1 //<=> dernier plus grand ack recu + 1
+	winSize := reglages.winSize
+	//fenêtre annoncée par le client : il accepte jusqu'au segment last_ack+rwnd
+	var rwnd atomic.Int64
+	rwnd.Store(int64(fenetreInitiale(c.options)))
+	persistance := delaiPersistance
+	h := c.temps()
+	derniereSonde := h.maintenant()
+	//avec "fec", des parités suivent chaque bloc de segments
+	fec := nouvelleProtection(c.options)
+	plusHautEnvoye := 0
+
+	send := func(num_seq int) error {
+		//Si le numéro de séquence courant ne dépasse pas la fin du fichier
+		if packet := decoupe.segment(num_seq); packet != nil {
+			//On envoie le paquet (le dernier a déjà été coupé à la bonne taille)
+			if _, err := c.conn.WriteTo(packet, c.addr); err != nil {
+				return err
+			}
+			j.Log(context.Background(), niveauPaquets, "segment envoyé", "seq", base+num_seq, "taille", len(packet))
+			stats.envoi(num_seq, len(packet))
+			c.trace.envoi(base+num_seq, len(packet))
+			//On set le timeout pour ce paquet
+			timeouts[num_seq-1] = h.maintenant()
+		}
+		return nil
+	}
+
+	window := func() bool {
+		//Si le # du prochain paquet est inférieur au dernier plus grand ack + 1
+		if next_seq < next_biggest_ack {
+			next_seq = next_biggest_ack
+		}
+
+		//on calcule le quotient ENTIER du nba-1 par le winSize
+		quotient := (next_biggest_ack - 1) / winSize
+
+		if lost_ack == true {
+			borneInf = next_biggest_ack
+			lost_ack = false
+			borneInfSlide = true
+		} else {
+			//Si la borne Inf n'a pas ete slidée
+			if borneInfSlide == false {
+				//on calcule la borne inférieure de la fenêtre en multipliant le quotient par le winSize et en ajoutant 1
+				borneInf = (quotient * winSize) + 1
+
+			} else { //la borne a été slidée
+				if borneSup < next_biggest_ack { //le next_biggest_ack devient supérieur à la borne Sup
+					borneInf = borneInf + winSize //on change alors la borne inférieure
+				}
+			}
+		}
+
+		//on calcule la borne supérieure de la fenêtre en ajoutant winSize-1 à la borne inf
+		borneSup = (borneInf + winSize - 1)
+
+		//On retourne true si le # de paquet courant est compris dans les bornes de la fenêtre en cours
+		if (next_seq >= borneInf) && (next_seq <= borneSup) {
+			return true
+		} else {
+			return false
+		}
+	}
+
+	//termine indique si le dernier plus grand ack est celui du dernier paquet, ou si envoyer a rendu la main
+	arrete := false
+	termine := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return arrete || decoupe.dernier(next_biggest_ack-1)
+	}
+
+	//avancer fait un pas de la goroutine d'envoi : un segment, une sonde de fenêtre ou un renvoi
+	avancer := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		//Si notre paquet est OK (dans notre fenêtre et dans celle du client)
+		if window() && next_seq <= last_ack+int(rwnd.Load()) {
+			//On l'envoie
+			if err := send(next_seq); err != nil {
+				return err
+			}
+			if fec != nil && next_seq > plusHautEnvoye {
+				plusHautEnvoye = next_seq
+				if err := fec.envoye(c, decoupe, next_seq); err != nil {
+					return err
+				}
+			}
+
+			//On passe au prochain paquet
+			next_seq++
+			stats.fenetre(next_seq-next_biggest_ack, int(rwnd.Load()))
+			persistance = delaiPersistance
+
+		} else if rwnd.Load() == 0 {
+			//Le client n'a plus de place : on le sonde de temps en temps pour connaître sa nouvelle fenêtre
+			if h.maintenant().Sub(derniereSonde) > persistance {
+				if err := send(next_biggest_ack); err != nil {
+					return err
+				}
+				derniereSonde = h.maintenant()
+				persistance = min(2*persistance, persistanceMax)
+			}
+		} else {
+			//Sinon, si le temps de timeout de l'ACK attendu est supérieur au timeout
+			if h.maintenant().Sub(timeouts[next_biggest_ack]) > reglages.timeout {
+				//Timeout -> On retransmet le paquet perdu
+				j.Debug("timeout", "seq", base+next_biggest_ack)
+				c.trace.perte(base+next_biggest_ack, "timeout")
+				next_seq = next_biggest_ack
+				stats.timeout()
+				if fec != nil {
+					fec.renvois.Add(1)
+				}
+				//des pertes répétées d'un gros segment : le chemin ne le laisse peut-être plus passer
+				if sondes != nil {
+					sondes.perte(next_biggest_ack, len(decoupe.segment(next_biggest_ack))+surcoutDatagramme(c.options))
+				}
+
+			}
+		}
+		c.trace.etatFenetre(base+borneInf, base+borneSup, base+next_seq, base+last_ack, int(rwnd.Load()))
+		return nil
+	}
+
+	//la goroutine d'envoi s'arrête à sa première erreur et la passe à la boucle des ACK
+	echec := make(chan error, 1)
+	envoiTermine := h.nouveauReveil()
+	h.lancer(func() {
+		defer envoiTermine.donner()
+		//tant que le dernier plus grand ack n'est pas celui du dernier paquet
+		for !termine() {
+
+			//On attend 1ms
+			h.dormir(time.Millisecond * 1)
+
+			if err := avancer(); err != nil {
+				echec <- err
+				return
+			}
+		}
+	})
+	//quoi qu'il arrive, la goroutine d'envoi ne survit pas à envoyer
+	defer func() {
+		mu.Lock()
+		arrete = true
+		mu.Unlock()
+		envoiTermine.attendre(-1)
+	}()
+
+	//traiterAck prend en compte un message du client
+	traiterAck := func(message []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		n := len(message)
+
+		//Le destinataire renonce (dépôt trop gros...) : inutile de continuer
+		if raison, ok := strings.CutPrefix(nettoyer(message), "DENY "); ok {
+			return fmt.Errorf("%w : %s", errRefus, raison)
+		}
+
+		//Le client a reçu une sonde de taille
+		if strings.HasPrefix(nettoyer(message), "ACKPMTU") {
+			if sondes != nil && n >= 13 {
+				c.trace.sonde(getSeq(string(message[7:13])))
+				sondes.reponse(getSeq(string(message[7:13])))
+			}
+			return nil
+		}
+
+		//Le client a reçu un segment corrompu : on le renvoie tout de suite
+		if strings.HasPrefix(nettoyer(message), "NACK") {
+			//seul un segment déjà envoyé et pas encore acquitté peut être redemandé
+			seq := getSeq(string(message[4:min(n, 10)])) - base
+			if seq >= next_biggest_ack && seq < next_seq && decoupe.segment(seq) != nil {
+				stats.nacks.Add(1)
+				nacksRecus.Add(1)
+				c.trace.reception("NACK", base+seq, -1)
+				c.trace.perte(base+seq, "nack")
+				return send(seq)
+			}
+			return nil
+		}
+
+		//en session, le client peut envoyer ses prochaines demandes pendant le transfert
+		if c.options.a("session") && c.noterRequete(string(message)) {
+			return nil
+		}
+
+		//on ne garde que les ACK (le destinataire peut répéter d'autres messages de contrôle)
+		if !strings.HasPrefix(nettoyer(message), "ACK") || n < 9 {
+			return nil
+		}
+
+		//on récupère le numéro de séquence (un ACK d'un transfert précédent de la session est ignoré)
+		ack := getSeq(string(message[3:9])) - base
+		if ack < 0 {
+			return nil
+		}
+
+		//et la fenêtre du client, s'il l'annonce : un ACK qui ne fait que l'ouvrir n'est pas un doublon
+		miseAJour := false
+		annoncee := -1
+		if fenetre, ok := lireFenetre(nettoyer(message)); ok {
+			miseAJour = int64(fenetre) != rwnd.Load()
+			rwnd.Store(int64(fenetre))
+			annoncee = fenetre
+		}
+		c.trace.reception("ACK", base+ack, annoncee)
+		if fec != nil {
+			fec.annonce(nettoyer(message))
+		}
+
+		//Si c'est le meme ack qu'avant -> on incrémente same_ack
+		if ack == last_ack && !miseAJour {
+			same_ack++
+			stats.acksDupliques.Add(1)
+			//A partir d'un certain nombre d'ack identiques recus, on renvoie le paquet perdu
+			//Fast retransmit
+			if same_ack > 2 {
+				j.Debug("ACK dupliqués : renvoi rapide", "seq", base+ack+1)
+				c.trace.perte(base+ack+1, "acks_dupliques")
+				next_seq = ack + 1
+				lost_ack = true
+				same_ack = 0
+				if fec != nil {
+					fec.renvois.Add(1)
+				}
+			}
+		}
+		//si l'ack est plus grand ou = à celui d'avant, il devient last_ack
+		if ack > last_ack {
+			stats.acquitte(ack)
+		}
+		if ack >= last_ack {
+			last_ack = ack
+		}
+
+		//Si l'ack est plus grand que le dernier plus grand ack recu +1, on met à jour ce dernier
+		if last_ack >= next_biggest_ack {
+			next_biggest_ack = last_ack + 1
+		}
+
+		//Fin de l'envoi : on envoie "FIN" au client (avec l'empreinte du fichier si demandée)
+		if decoupe.dernier(last_ack) {
+			j.Debug("fin de l'envoi", "segments", last_ack)
+			if err := decoupe.erreur(); err != nil {
+				return err //fichier illisible : le destinataire ne doit pas croire l'avoir reçu en entier
+			}
+			fin = c.marquer(messageFin(formaterEmpreinte(empreinte)))
+			if _, err := c.conn.WriteTo(fin, c.addr); err != nil {
+				return err
+			}
+			c.trace.finEnvoi(base + last_ack)
+		}
+		return nil
+	}
+
+	//tant que le plus grand ack n'est pas celui du dernier paquet,
+	//on lit les ACK ; l'échéance régulière permet de voir si la goroutine d'envoi a échoué,
+	//et de renoncer au destinataire s'il ne répond plus (socket fermée, machine partie)
+	defer c.conn.SetReadDeadline(time.Time{})
+	silences := 0
+	for !termine() {
+		select {
+		case err := <-echec:
+			return nil, err
+		default:
+		}
+		//On lit l'ack recu
+		c.conn.SetReadDeadline(h.maintenant().Add(delaiControle))
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if silences++; silences > essaisInactivite {
+					return nil, fmt.Errorf("plus de nouvelles de %v", c.addr)
+				}
+				continue
+			}
+			return nil, err
+		}
+		//on ne prend en compte que les ACK du client
+		if !memeAdresse(from, c.addr) {
+			continue
+		}
+		silences = 0
+		j.Log(context.Background(), niveauPaquets, "reçu", "message", nettoyer(buf[:n]))
+		if err := traiterAck(buf[:n]); err != nil {
+			return nil, err
+		}
+	}
+
+	//Fichier vide : il n'y a aucun segment à acquitter, on termine tout de suite
+	if fin == nil {
+		if err := decoupe.erreur(); err != nil {
+			return nil, err
+		}
+		fin = c.marquer(messageFin(formaterEmpreinte(empreinte)))
+		if _, err := c.conn.WriteTo(fin, c.addr); err != nil {
+			return nil, err
+		}
+		c.trace.finEnvoi(base)
+	}
+
+	stats.terminer(fi.Size())
+	mu.Lock()
+	defer mu.Unlock()
+	c.base = base + last_ack
+	c.fin = fin
+	return fin, nil
+}
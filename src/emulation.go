@@ -0,0 +1,473 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*--------------------EMULATION DU RESEAU----------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec -emulation "<réglages>", le serveur et le client Go font passer leurs
+datagrammes par un réseau émulé, dans le programme, comme netem mais sans
+être root : on reproduit ainsi sur loopback les conditions du scénario 2.
+Les réglages, séparés par des espaces (probabilités en fraction ou en %) :
+	perte=2%            perte aléatoire de chaque datagramme
+	rafales=1%/30%      pertes en rafales (Gilbert-Elliott) : probabilités de
+	                    passer de l'état bon au mauvais, puis de revenir
+	perte-rafale=100%   perte dans l'état mauvais (par défaut 100 %)
+	delai=20ms          latence ajoutée
+	gigue=5ms           variation de la latence, uniforme dans ±gigue
+	debit=10M           débit en bits/s (suffixes k, M, G), 0 : illimité
+	file=1000           datagrammes en attente au plus, au-delà ils sont perdus
+	desordre=1%         datagrammes retenus (max(delai, 2×gigue, 5ms) de plus)
+	                    pour être doublés par les suivants
+	double=1%           datagrammes dupliqués
+	sens=les-deux       envoi, reception ou les-deux
+	graine=42           tirages reproductibles (0 : au hasard)
+Chaque sens de chaque socket est un lien indépendant, qui garde l'ordre des
+datagrammes sauf gigue ou desordre. Un datagramme retardé est écrit plus tard
+en arrière-plan : une erreur d'envoi le perd ; fermer la socket attend que
+ceux déjà envoyés soient partis, et perd ceux qui étaient en route vers elle.
+La capture (-capture) voit les datagrammes comme le programme : avant l'émulation à
+l'envoi, après à la réception. */
+
+// reglagesEmulation sont les conditions du réseau émulé
+type reglagesEmulation struct {
+	perte       float64
+	versMauvais float64 // Gilbert-Elliott : bon -> mauvais, à chaque datagramme
+	versBon     float64 // Gilbert-Elliott : mauvais -> bon
+	perteRafale float64
+	delai       time.Duration
+	gigue       time.Duration
+	debit       float64 // octets par seconde, 0 : illimité
+	file        int
+	desordre    float64
+	double      float64
+	envoi       bool
+	reception   bool
+	graine      uint64
+}
+
+// liens créés, pour que chacun ait ses propres tirages avec la même graine
+var liensCrees atomic.Uint64
+
+// lireEmulation lit les réglages du réseau émulé ; "" : pas d'émulation (nil)
+func lireEmulation(texte string) (*reglagesEmulation, error) {
+	if strings.TrimSpace(texte) == "" {
+		return nil, nil
+	}
+	r := &reglagesEmulation{perteRafale: 1, file: 1000, envoi: true, reception: true}
+	for cle, valeur := range lireOptions(strings.Fields(texte)) {
+		var err error
+		switch cle {
+		case "perte":
+			r.perte, err = lireProbabilite(valeur)
+		case "rafales":
+			mauvais, bon, _ := strings.Cut(valeur, "/")
+			if r.versMauvais, err = lireProbabilite(mauvais); err == nil {
+				r.versBon, err = lireProbabilite(bon)
+			}
+		case "perte-rafale":
+			r.perteRafale, err = lireProbabilite(valeur)
+		case "delai":
+			r.delai, err = time.ParseDuration(valeur)
+		case "gigue":
+			r.gigue, err = time.ParseDuration(valeur)
+		case "debit":
+			r.debit, err = lireDebit(valeur)
+		case "file":
+			r.file, err = strconv.Atoi(valeur)
+		case "desordre":
+			r.desordre, err = lireProbabilite(valeur)
+		case "double":
+			r.double, err = lireProbabilite(valeur)
+		case "sens":
+			switch valeur {
+			case "envoi":
+				r.reception = false
+			case "reception":
+				r.envoi = false
+			case "les-deux":
+			default:
+				err = fmt.Errorf("envoi, reception ou les-deux")
+			}
+		case "graine":
+			r.graine, err = strconv.ParseUint(valeur, 10, 64)
+		default:
+			return nil, fmt.Errorf("émulation : réglage inconnu %q", cle)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("émulation : %s=%s : %v", cle, valeur, err)
+		}
+	}
+	if r.delai < 0 || r.gigue < 0 || r.file <= 0 {
+		return nil, fmt.Errorf("émulation : delai, gigue et file doivent être positifs")
+	}
+	return r, nil
+}
+
+// lireProbabilite lit "0.02" ou "2%"
+func lireProbabilite(texte string) (float64, error) {
+	diviseur := 1.0
+	if t, ok := strings.CutSuffix(texte, "%"); ok {
+		texte, diviseur = t, 100
+	}
+	p, err := strconv.ParseFloat(texte, 64)
+	if err != nil {
+		return 0, err
+	}
+	p /= diviseur
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probabilité hors de [0, 1]")
+	}
+	return p, nil
+}
+
+// lireDebit lit un débit en bits/s ("10M") et le renvoie en octets/s
+func lireDebit(texte string) (float64, error) {
+	multiple := 1.0
+	switch {
+	case strings.HasSuffix(texte, "k"):
+		multiple = 1e3
+	case strings.HasSuffix(texte, "M"):
+		multiple = 1e6
+	case strings.HasSuffix(texte, "G"):
+		multiple = 1e9
+	}
+	if multiple > 1 {
+		texte = texte[:len(texte)-1]
+	}
+	d, err := strconv.ParseFloat(texte, 64)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("débit invalide")
+	}
+	return d * multiple / 8, nil
+}
+
+// lien est un sens d'une socket émulée
+type lien struct {
+	r       *reglagesEmulation
+	livrer  func(p []byte, addr net.Addr) // remet le datagramme qui a traversé le lien
+	mu      sync.Mutex
+	hasard  *rand.Rand
+	mauvais bool      // état de Gilbert-Elliott
+	libre   time.Time // date où le lien aura fini d'émettre ce qui l'attend (débit)
+	file    fileLien  // datagrammes en route, par date d'arrivée
+	numero  int       // numéro du prochain datagramme mis en file
+	actif   bool      // la goroutine de distribution tourne
+	arrete  bool      // le lien ne transmet plus rien (socket fermée)
+	reveil  chan struct{}
+	vide    *sync.Cond // signalé quand la file se vide
+}
+
+// enRoute est un datagramme qui traverse le lien
+type enRoute struct {
+	arrivee time.Time
+	numero  int // à date égale, l'ordre d'envoi
+	donnees []byte
+	addr    net.Addr
+}
+
+// fileLien est un tas de datagrammes, le prochain à arriver en tête
+type fileLien []enRoute
+
+func (f fileLien) Len() int { return len(f) }
+func (f fileLien) Less(i, j int) bool {
+	if f[i].arrivee.Equal(f[j].arrivee) {
+		return f[i].numero < f[j].numero
+	}
+	return f[i].arrivee.Before(f[j].arrivee)
+}
+func (f fileLien) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f *fileLien) Push(x any)   { *f = append(*f, x.(enRoute)) }
+func (f *fileLien) Pop() any {
+	dernier := (*f)[len(*f)-1]
+	*f = (*f)[:len(*f)-1]
+	return dernier
+}
+
+func nouveauLien(r *reglagesEmulation, livrer func([]byte, net.Addr)) *lien {
+	graine := r.graine
+	if graine == 0 {
+		graine = rand.Uint64()
+	}
+	l := &lien{r: r, livrer: livrer, hasard: rand.New(rand.NewPCG(graine, liensCrees.Add(1))), reveil: make(chan struct{}, 1)}
+	l.vide = sync.NewCond(&l.mu)
+	return l
+}
+
+// tirer décide du sort d'un datagramme de taille octets envoyé à maintenant, quand
+// enAttente datagrammes sont déjà en route : les dates d'arrivée de ses copies
+// (aucune : il est perdu). La simulation s'en sert avec son horloge virtuelle.
+func (l *lien) tirer(taille int, maintenant time.Time, enAttente int) []time.Time {
+	if l.mauvais {
+		l.mauvais = l.hasard.Float64() >= l.r.versBon
+	} else {
+		l.mauvais = l.hasard.Float64() < l.r.versMauvais
+	}
+	taux := l.r.perte
+	if l.mauvais {
+		taux = l.r.perteRafale
+	}
+	if l.hasard.Float64() < taux {
+		return nil
+	}
+	copies := 1
+	if l.hasard.Float64() < l.r.double {
+		copies = 2
+	}
+
+	var arrivees []time.Time
+	for range copies {
+		if enAttente+len(arrivees) >= l.r.file {
+			break //file pleine : perdu
+		}
+		depart := maintenant
+		if l.r.debit > 0 {
+			l.libre = maxDate(l.libre, maintenant).Add(time.Duration(float64(taille) / l.r.debit * float64(time.Second)))
+			depart = l.libre
+		}
+		arrivee := depart.Add(l.r.delai)
+		if l.r.gigue > 0 {
+			arrivee = arrivee.Add(time.Duration((2*l.hasard.Float64() - 1) * float64(l.r.gigue)))
+		}
+		if l.hasard.Float64() < l.r.desordre {
+			arrivee = arrivee.Add(max(l.r.delai, 2*l.r.gigue, 5*time.Millisecond))
+		}
+		arrivees = append(arrivees, arrivee)
+	}
+	return arrivees
+}
+
+// passer fait traverser le lien à p : il est perdu, ou livré (plus tard, en double...)
+func (l *lien) passer(p []byte, addr net.Addr) {
+	l.mu.Lock()
+	if l.arrete {
+		l.mu.Unlock()
+		return
+	}
+	maintenant := time.Now()
+	arrivees := l.tirer(len(p), maintenant, len(l.file))
+	if len(arrivees) == 0 {
+		l.mu.Unlock()
+		return
+	}
+	//rien à retarder ni à doubler : on livre tout de suite, sans passer par la file
+	direct := len(arrivees) == 1 && !l.actif && !arrivees[0].After(maintenant)
+	if !direct {
+		for _, arrivee := range arrivees {
+			heap.Push(&l.file, enRoute{arrivee: arrivee, numero: l.numero, donnees: append([]byte(nil), p...), addr: addr})
+			l.numero++
+		}
+	}
+	lancer := len(l.file) > 0 && !l.actif
+	l.actif = l.actif || lancer
+	l.mu.Unlock()
+
+	switch {
+	case direct:
+		l.livrer(p, addr)
+	case lancer:
+		go l.distribuer()
+	default:
+		select {
+		case l.reveil <- struct{}{}: //un datagramme est peut-être à livrer plus tôt
+		default:
+		}
+	}
+}
+
+// distribuer livre les datagrammes de la file à leur date d'arrivée, et s'arrête quand elle est vide
+func (l *lien) distribuer() {
+	minuteur := time.NewTimer(0)
+	defer minuteur.Stop()
+	for {
+		l.mu.Lock()
+		if len(l.file) == 0 {
+			l.actif = false
+			l.vide.Broadcast()
+			l.mu.Unlock()
+			return
+		}
+		attente := time.Until(l.file[0].arrivee)
+		if attente <= 0 {
+			d := heap.Pop(&l.file).(enRoute)
+			l.mu.Unlock()
+			l.livrer(d.donnees, d.addr)
+			continue
+		}
+		l.mu.Unlock()
+		minuteur.Reset(attente)
+		select {
+		case <-minuteur.C:
+		case <-l.reveil:
+			if !minuteur.Stop() {
+				<-minuteur.C
+			}
+		}
+	}
+}
+
+// attendre rend la main quand tout ce qui est en route a été livré
+func (l *lien) attendre() {
+	l.mu.Lock()
+	for l.actif {
+		l.vide.Wait()
+	}
+	l.mu.Unlock()
+}
+
+// arreter perd ce qui est encore en route et attend que la distribution s'arrête
+func (l *lien) arreter() {
+	l.mu.Lock()
+	l.arrete = true
+	l.file = nil
+	l.mu.Unlock()
+	select {
+	case l.reveil <- struct{}{}:
+	default:
+	}
+	l.attendre()
+}
+
+func maxDate(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// connEmulee est une socket dont les datagrammes passent par le réseau émulé
+type connEmulee struct {
+	net.PacketConn
+	envoi     *lien // nil : pas d'émulation dans ce sens
+	reception *lien
+	recus     chan datagramme
+	lancer    sync.Once
+	fini      chan struct{}
+	err       error
+	echeance  echeanceLecture
+	fermee    atomic.Bool
+	ferme     chan struct{} // fermé par Close, avant la vraie socket
+}
+
+// emuler renvoie conn, dont les datagrammes passent par le réseau émulé si r n'est pas nil
+func emuler(conn net.PacketConn, r *reglagesEmulation) net.PacketConn {
+	if r == nil {
+		return conn
+	}
+	c := &connEmulee{PacketConn: conn, recus: make(chan datagramme, r.file), fini: make(chan struct{}), ferme: make(chan struct{})}
+	if r.envoi {
+		c.envoi = nouveauLien(r, func(p []byte, addr net.Addr) {
+			_, _ = conn.WriteTo(p, addr)
+		})
+	}
+	if r.reception {
+		c.reception = nouveauLien(r, func(p []byte, addr net.Addr) {
+			select {
+			case c.recus <- datagramme{append([]byte(nil), p...), addr}: //p est le tampon de pomper
+			default: //la socket ne lit pas assez vite : perdu
+			}
+		})
+	}
+	return c
+}
+
+func (c *connEmulee) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.envoi == nil {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	if c.fermee.Load() {
+		return 0, net.ErrClosed
+	}
+	c.envoi.passer(p, addr)
+	return len(p), nil
+}
+
+// pomper lit la vraie socket et fait passer chaque datagramme par le lien de réception
+func (c *connEmulee) pomper() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			c.err = err
+			close(c.fini)
+			return
+		}
+		c.reception.passer(buf[:n], from)
+	}
+}
+
+func (c *connEmulee) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.reception == nil {
+		return c.PacketConn.ReadFrom(b)
+	}
+	c.lancer.Do(func() { go c.pomper() })
+	for {
+		delai, change, arreter := c.echeance.armer(horlogeSysteme{})
+		select {
+		case d := <-c.recus:
+			arreter()
+			return copy(b, d.donnees), d.addr, nil
+		case <-delai:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-change: //nouvelle échéance : on réarme le délai
+		case <-c.ferme:
+			arreter()
+			return 0, nil, net.ErrClosed
+		case <-c.fini:
+			arreter()
+			return 0, nil, c.err
+		}
+		arreter()
+	}
+}
+
+// Close rend la main tout de suite, mais les datagrammes déjà envoyés arrivent
+// quand même, comme sur un vrai réseau (sans cela, le FIN écrit juste avant la
+// fermeture serait toujours perdu) : la vraie socket n'est fermée qu'une fois le
+// dernier livré. Ce qui était en route vers la socket est perdu, comme pour une
+// vraie socket fermée.
+func (c *connEmulee) Close() error {
+	if c.fermee.Swap(true) {
+		return net.ErrClosed
+	}
+	close(c.ferme)
+	if c.reception != nil {
+		c.reception.arreter()
+	}
+	if c.envoi == nil {
+		return c.PacketConn.Close()
+	}
+	go func() {
+		c.envoi.attendre()
+		_ = c.PacketConn.Close()
+	}()
+	return nil
+}
+
+// SetReadDeadline s'applique à la file des datagrammes reçus, pas à la vraie socket
+func (c *connEmulee) SetReadDeadline(t time.Time) error {
+	if c.reception == nil {
+		return c.PacketConn.SetReadDeadline(t)
+	}
+	c.echeance.fixer(t)
+	return nil
+}
+
+func (c *connEmulee) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.PacketConn.SetWriteDeadline(t)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*-------------------------------------------------------------- */
+/*------------------CORRECTION D'ERREURS (FEC)------------------ */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "fec=<algos>" (le client en propose, le serveur en choisit un :
+"rs" pour Reed-Solomon, "xor"), l'émetteur ajoute après chaque bloc de
+fecBloc segments des segments de parité qui permettent au destinataire de
+reconstruire des segments perdus sans attendre leur renvoi :
+	FEC<premier segment sur 6 chiffres><segments du bloc sur 2 chiffres><indice sur 2 chiffres><parité>
+La parité porte sur les segments entiers (numéro et CRC compris), chacun
+précédé de sa taille sur 2 octets et complété par des zéros jusqu'au plus
+grand du bloc. Avec "xor" il y a au plus une parité par bloc (le XOR des
+segments) et on reconstruit un segment perdu ; avec "rs" (code de Cauchy sur
+GF(256)) r parités permettent d'en reconstruire r.
+
+Le nombre de parités par bloc suit les pertes constatées : les renvois de
+l'émetteur et les segments reconstruits par le destinataire, qu'il annonce
+dans ses ACK ("rec=<total>"). Les segments de données sont raccourcis de
+surcoutFEC octets pour que la parité tienne dans un datagramme. */
+
+// algorithmes de correction connus, par ordre de préférence du serveur
+var algosFEC = []string{"rs", "xor"}
+
+// nombre de segments de données par bloc
+const fecBloc = 8
+
+// nombre maximal de parités par bloc
+const fecPariteMax = 4
+
+// taille de l'en-tête d'une parité, plus la taille du segment ajoutée dans la parité
+const enteteFEC = 3 + 6 + 2 + 2
+const surcoutFEC = enteteFEC + 2
+
+// taux de pertes supposé avant toute mesure (une parité par bloc)
+const fecPerteInitiale = 0.05
+
+// au-delà de cette distance derrière le plus grand segment reçu, on oublie les segments et les blocs
+const fecGarde = 1024
+
+// choisirFEC renvoie le premier algorithme de la liste du client que l'on connaît, "" sinon
+func choisirFEC(demande string) string {
+	for _, algo := range strings.Split(demande, ",") {
+		for _, connu := range algosFEC {
+			if algo == connu {
+				return algo
+			}
+		}
+	}
+	return ""
+}
+
+// surcoutCorrection renvoie la place réservée dans chaque datagramme pour les parités
+func surcoutCorrection(opts options) int {
+	if opts.a("fec") {
+		return surcoutFEC
+	}
+	return 0
+}
+
+/*--------------------------GF(256)---------------------------- */
+
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// ajouterMultiple fait dst ^= coef*src octet par octet
+func ajouterMultiple(dst, src []byte, coef byte) {
+	if coef == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(coef, b)
+	}
+}
+
+// coefficient renvoie le poids du segment j du bloc dans la parité i
+func coefficient(algo string, i, j int) byte {
+	if algo == "xor" {
+		return 1
+	}
+	//matrice de Cauchy : 1/(x_i + y_j) avec x_i = fecBloc+i et y_j = j, tous distincts
+	return gfInv(byte(fecBloc+i) ^ byte(j))
+}
+
+// encoder met un segment sous la forme utilisée dans les parités
+func encoder(segment []byte, taille int) []byte {
+	e := make([]byte, taille)
+	binary.BigEndian.PutUint16(e, uint16(len(segment)))
+	copy(e[2:], segment)
+	return e
+}
+
+/*--------------------------EMETTEUR--------------------------- */
+
+// protection calcule et envoie les parités de chaque bloc, côté émetteur
+type protection struct {
+	algo         string
+	perte        float64      //taux de pertes estimé
+	envois       int          //segments envoyés lors de la dernière estimation
+	pertesVues   int          //pertes comptées lors de la dernière estimation
+	renvois      atomic.Int64 //pertes constatées par l'émetteur (timeouts, ACK dupliqués)
+	reconstruits atomic.Int64 //segments reconstruits par le destinataire
+}
+
+// nouvelleProtection renvoie nil si "fec" n'a pas été négocié
+func nouvelleProtection(opts options) *protection {
+	if !opts.a("fec") {
+		return nil
+	}
+	return &protection{algo: opts["fec"], perte: fecPerteInitiale}
+}
+
+// annonce note le nombre de segments reconstruits annoncé dans un ACK ("rec=<total>")
+func (p *protection) annonce(ack string) {
+	champs := strings.Fields(ack)
+	if len(champs) < 2 {
+		return
+	}
+	if rec, err := strconv.Atoi(lireOptions(champs[1:])["rec"]); err == nil && int64(rec) > p.reconstruits.Load() {
+		p.reconstruits.Store(int64(rec))
+	}
+}
+
+// redondance met à jour le taux de pertes et renvoie le nombre de parités du prochain bloc
+func (p *protection) redondance(envoyes int) int {
+	pertes := int(p.renvois.Load() + p.reconstruits.Load())
+	if envoyes > p.envois {
+		mesure := float64(pertes-p.pertesVues) / float64(envoyes-p.envois)
+		p.perte = 0.75*p.perte + 0.25*min(mesure, 1)
+		p.envois, p.pertesVues = envoyes, pertes
+	}
+	//deux fois les pertes attendues sur le bloc, pour absorber les rafales
+	r := int(math.Ceil(2 * p.perte * fecBloc))
+	if p.algo == "xor" {
+		return min(r, 1)
+	}
+	return min(r, fecPariteMax)
+}
+
+// envoye est appelé quand le segment num est envoyé pour la première fois : s'il
+// termine un bloc, les parités du bloc partent juste après
+func (p *protection) envoye(c *connexion, d *decoupage, num int) error {
+	if num%fecBloc != 0 && !d.dernier(num) {
+		return nil
+	}
+	premier := (num-1)/fecBloc*fecBloc + 1
+	r := p.redondance(num)
+	if r == 0 {
+		return nil
+	}
+	segments := make([][]byte, 0, num-premier+1)
+	taille := 0
+	for i := premier; i <= num; i++ {
+		s := d.segment(i)
+		segments = append(segments, s)
+		taille = max(taille, len(s)+2)
+	}
+	for i := range r {
+		parite := make([]byte, enteteFEC+taille)
+		copy(parite, fmt.Sprintf("FEC%06d%02d%02d", d.base+premier, len(segments), i))
+		for j, s := range segments {
+			ajouterMultiple(parite[enteteFEC:], encoder(s, taille), coefficient(p.algo, i, j))
+		}
+		if _, err := c.conn.WriteTo(parite, c.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*------------------------DESTINATAIRE------------------------- */
+
+// bloc rassemble les parités reçues d'un bloc
+type bloc struct {
+	n       int            //nombre de segments de données du bloc
+	parites map[int][]byte //parités reçues, par indice
+}
+
+// correcteur reconstruit les segments perdus à partir des parités, côté destinataire
+type correcteur struct {
+	mu           sync.Mutex
+	algo         string
+	recents      map[int][]byte //segments reçus, par numéro (tels que reçus)
+	blocs        map[int]*bloc  //blocs dont on a reçu une parité, par premier numéro
+	plusHaut     int            //plus grand numéro reçu
+	reconstruits int
+}
+
+// nouveauCorrecteur renvoie nil si "fec" n'a pas été négocié
+func nouveauCorrecteur(opts options) *correcteur {
+	if !opts.a("fec") {
+		return nil
+	}
+	return &correcteur{algo: opts["fec"], recents: make(map[int][]byte), blocs: make(map[int]*bloc)}
+}
+
+// champ renvoie ce que le destinataire ajoute à ses ACK
+func (c *correcteur) champ() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf(" rec=%d", c.reconstruits)
+}
+
+// donnee note un segment reçu et renvoie les segments que son arrivée permet de reconstruire
+func (c *correcteur) donnee(seq int, segment []byte) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recents[seq] = append([]byte(nil), segment...)
+	c.oublier(seq)
+	for premier, b := range c.blocs {
+		if seq >= premier && seq < premier+b.n {
+			return c.essayer(premier, b)
+		}
+	}
+	return nil
+}
+
+// parite note une parité reçue et renvoie les segments qu'elle permet de reconstruire
+func (c *correcteur) parite(message []byte) [][]byte {
+	if len(message) < enteteFEC {
+		return nil
+	}
+	premier, err1 := strconv.Atoi(string(message[3:9]))
+	n, err2 := strconv.Atoi(string(message[9:11]))
+	indice, err3 := strconv.Atoi(string(message[11:13]))
+	if err1 != nil || err2 != nil || err3 != nil || n < 1 || n > fecBloc || indice >= fecPariteMax {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if premier+n <= c.plusHaut-fecGarde {
+		return nil
+	}
+	b, ok := c.blocs[premier]
+	if !ok {
+		b = &bloc{n: n, parites: make(map[int][]byte)}
+		c.blocs[premier] = b
+	}
+	b.parites[indice] = append([]byte(nil), message[enteteFEC:]...)
+	return c.essayer(premier, b)
+}
+
+// oublier efface ce qui est trop loin derrière le segment seq (verrou pris)
+func (c *correcteur) oublier(seq int) {
+	if seq <= c.plusHaut {
+		return
+	}
+	c.plusHaut = seq
+	for s := range c.recents {
+		if s < seq-fecGarde {
+			delete(c.recents, s)
+		}
+	}
+	for premier := range c.blocs {
+		if premier < seq-fecGarde {
+			delete(c.blocs, premier)
+		}
+	}
+}
+
+// essayer reconstruit les segments manquants du bloc si on a assez de parités (verrou pris)
+func (c *correcteur) essayer(premier int, b *bloc) [][]byte {
+	var manquants []int
+	for j := range b.n {
+		if _, ok := c.recents[premier+j]; !ok {
+			manquants = append(manquants, j)
+		}
+	}
+	if len(manquants) == 0 {
+		delete(c.blocs, premier) //bloc complet : ses parités ne servent plus
+		return nil
+	}
+	if len(manquants) > len(b.parites) {
+		return nil //pas encore assez de parités
+	}
+
+	//une équation par parité : sum(coef * manquant) = parité - sum(coef * reçu)
+	var lignes []int
+	var membres [][]byte
+	for i, p := range b.parites {
+		if len(lignes) == len(manquants) {
+			break
+		}
+		membre := append([]byte(nil), p...)
+		for j := range b.n {
+			if s, ok := c.recents[premier+j]; ok {
+				if len(s)+2 > len(membre) {
+					return nil //parité incohérente avec les segments reçus
+				}
+				ajouterMultiple(membre, encoder(s, len(membre)), coefficient(c.algo, i, j))
+			}
+		}
+		lignes = append(lignes, i)
+		membres = append(membres, membre)
+	}
+	matrice := make([][]byte, len(lignes))
+	for a, i := range lignes {
+		matrice[a] = make([]byte, len(manquants))
+		for b, j := range manquants {
+			matrice[a][b] = coefficient(c.algo, i, j)
+		}
+	}
+	if !resoudre(matrice, membres) {
+		return nil
+	}
+
+	delete(c.blocs, premier)
+	var segments [][]byte
+	for b, j := range manquants {
+		taille := int(binary.BigEndian.Uint16(membres[b]))
+		if taille+2 > len(membres[b]) {
+			continue
+		}
+		segment := membres[b][2 : 2+taille]
+		c.recents[premier+j] = segment
+		c.reconstruits++
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// resoudre fait le pivot de Gauss sur GF(256) : en sortie, membres[b] est la solution b
+func resoudre(matrice [][]byte, membres [][]byte) bool {
+	n := len(matrice)
+	for col := range n {
+		pivot := -1
+		for l := col; l < n; l++ {
+			if matrice[l][col] != 0 {
+				pivot = l
+				break
+			}
+		}
+		if pivot < 0 {
+			return false
+		}
+		matrice[col], matrice[pivot] = matrice[pivot], matrice[col]
+		membres[col], membres[pivot] = membres[pivot], membres[col]
+
+		inv := gfInv(matrice[col][col])
+		for k := range matrice[col] {
+			matrice[col][k] = gfMul(matrice[col][k], inv)
+		}
+		for k := range membres[col] {
+			membres[col][k] = gfMul(membres[col][k], inv)
+		}
+		for l := range n {
+			if l != col && matrice[l][col] != 0 {
+				coef := matrice[l][col]
+				ajouterMultiple(matrice[l], matrice[col], coef)
+				ajouterMultiple(membres[l], membres[col], coef)
+			}
+		}
+	}
+	return true
+}
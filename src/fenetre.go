@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*-------------------FENETRE DE RECEPTION DU CLIENT------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "rwnd=<segments>", le client annonce dans son SYN combien de
+segments il peut garder en attente d'écriture, puis ajoute à chaque ACK la
+place qui lui reste ("ACK000042 rwnd=17") : il accepte les segments jusqu'au
+numéro acquitté plus cette fenêtre et jette les suivants. Le serveur n'envoie
+que ce que permettent à la fois sa propre fenêtre (winSize) et celle du
+client. Quand le client annonce une fenêtre nulle, le serveur lui renvoie de
+temps en temps le premier segment non acquitté (sonde de fenêtre, avec un délai
+qui double jusqu'à persistanceMax) pour recevoir un ACK avec la nouvelle
+fenêtre, au cas où le client n'aurait pas pu la lui annoncer. */
+
+// nombre de segments que le client Go peut garder en attente d'écriture sur le disque
+const tamponReception = 256
+
+// délai entre deux sondes de fenêtre nulle, doublé à chaque sonde
+const delaiPersistance = 100 * time.Millisecond
+const persistanceMax = 2 * time.Second
+
+// fenetreInconnue est la fenêtre d'un client qui ne l'annonce pas : seul winSize limite l'envoi
+const fenetreInconnue = 1 << 30
+
+// fenetreInitiale renvoie la fenêtre annoncée dans le SYN
+func fenetreInitiale(opts options) int {
+	if rwnd, err := strconv.Atoi(opts["rwnd"]); err == nil && rwnd >= 0 {
+		return rwnd
+	}
+	return fenetreInconnue
+}
+
+// lireFenetre renvoie la fenêtre annoncée dans un ACK ("ACK<seq> rwnd=<segments>")
+func lireFenetre(ack string) (int, bool) {
+	champs := strings.Fields(ack)
+	if len(champs) < 2 {
+		return 0, false
+	}
+	rwnd, err := strconv.Atoi(lireOptions(champs[1:])["rwnd"])
+	return rwnd, err == nil && rwnd >= 0
+}
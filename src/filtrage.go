@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*------------------FILTRAGE ET LIMITES DE CONNEXIONS----------- */
+/*-------------------------------------------------------------- */
+
+/* Fichier de filtrage (-filtre), relu quand le serveur reçoit SIGHUP :
+	# commentaire
+	autoriser 192.0.2.0/24
+	refuser 192.0.2.66/32
+	max-par-ip 4
+	max-total 64
+Une adresse qui correspond à une règle "refuser" est toujours refusée. S'il y a
+des règles "autoriser", seules les adresses qui correspondent à l'une d'elles
+sont acceptées. max-par-ip et max-total bornent le nombre de connexions
+simultanées (0 ou absent : pas de limite). Un client refusé reçoit
+"DENY <raison>", un client qui dépasse une limite reçoit "BUSY <raison>". */
+
+// au-delà de cette durée, un handshake qui n'a pas reçu son ACK est abandonné
+const dureeHandshake = 10 * time.Second
+
+// regles est le contenu du fichier de filtrage
+type regles struct {
+	autoriser []netip.Prefix
+	refuser   []netip.Prefix
+	maxParIP  int
+	maxTotal  int
+}
+
+// lireFiltre charge le fichier de filtrage
+func lireFiltre(chemin string) (*regles, error) {
+	fichier, err := os.Open(chemin)
+	if err != nil {
+		return nil, err
+	}
+	defer fichier.Close()
+
+	r := &regles{}
+	lignes := bufio.NewScanner(fichier)
+	for numero := 1; lignes.Scan(); numero++ {
+		ligne := strings.TrimSpace(lignes.Text())
+		if ligne == "" || strings.HasPrefix(ligne, "#") {
+			continue
+		}
+		champs := strings.Fields(ligne)
+		if len(champs) != 2 {
+			return nil, fmt.Errorf("%s:%d : <règle> <valeur> attendus", chemin, numero)
+		}
+		switch champs[0] {
+		case "autoriser", "refuser":
+			reseau, err := lirePrefixe(champs[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d : %v", chemin, numero, err)
+			}
+			if champs[0] == "autoriser" {
+				r.autoriser = append(r.autoriser, reseau)
+			} else {
+				r.refuser = append(r.refuser, reseau)
+			}
+		case "max-par-ip", "max-total":
+			max, err := strconv.Atoi(champs[1])
+			if err != nil || max < 0 {
+				return nil, fmt.Errorf("%s:%d : nombre invalide %q", chemin, numero, champs[1])
+			}
+			if champs[0] == "max-par-ip" {
+				r.maxParIP = max
+			} else {
+				r.maxTotal = max
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d : règle %q inconnue", chemin, numero, champs[0])
+		}
+	}
+	return r, lignes.Err()
+}
+
+// rechargerFiltre relit le fichier de filtrage à chaque SIGHUP ; en cas d'erreur, les règles précédentes restent en place
+func rechargerFiltre(chemin string, filtre *atomic.Pointer[regles]) {
+	signaux := make(chan os.Signal, 1)
+	signal.Notify(signaux, syscall.SIGHUP)
+	go func() {
+		for range signaux {
+			r, err := lireFiltre(chemin)
+			if err != nil {
+				journal.Error("filtre non rechargé, les règles précédentes restent", "fichier", chemin, "err", err)
+				continue
+			}
+			filtre.Store(r)
+		}
+	}()
+}
+
+// lirePrefixe accepte un réseau CIDR ou une adresse seule
+func lirePrefixe(texte string) (netip.Prefix, error) {
+	if strings.Contains(texte, "/") {
+		reseau, err := netip.ParsePrefix(texte)
+		return reseau.Masked(), err
+	}
+	ip, err := netip.ParseAddr(texte)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()), nil
+}
+
+// ipClient renvoie l'adresse IP d'un client, sans le préfixe IPv4 dans IPv6
+func ipClient(addr *net.UDPAddr) netip.Addr {
+	return addr.AddrPort().Addr().Unmap()
+}
+
+// autorise indique si les règles acceptent l'adresse
+func (r *regles) autorise(ip netip.Addr) bool {
+	for _, reseau := range r.refuser {
+		if reseau.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.autoriser) == 0 {
+		return true
+	}
+	for _, reseau := range r.autoriser {
+		if reseau.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// registre des connexions en cours, partagé entre main et les goroutines file
+type registre struct {
+	mu    sync.Mutex
+	conns map[string]*connexion //clé = ip:port du client
+}
+
+func nouveauRegistre() *registre {
+	return &registre{conns: make(map[string]*connexion)}
+}
+
+func (r *registre) trouver(cle string) *connexion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[cle]
+}
+
+// nombre renvoie le nombre de connexions ouvertes (une socket de données chacune)
+func (r *registre) nombre() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+func (r *registre) ajouter(cle string, c *connexion) {
+	r.mu.Lock()
+	r.conns[cle] = c
+	r.mu.Unlock()
+}
+
+// retirer oublie une connexion terminée ou abandonnée et ferme sa socket de données
+func (r *registre) retirer(cle string) {
+	r.mu.Lock()
+	c := r.conns[cle]
+	delete(r.conns, cle)
+	r.mu.Unlock()
+	if c != nil {
+		c.conn.Close()
+	}
+}
+
+// vider retire toutes les connexions et ferme leurs sockets (arrêt du serveur)
+func (r *registre) vider() {
+	r.mu.Lock()
+	cles := slices.Collect(maps.Keys(r.conns))
+	r.mu.Unlock()
+	for _, cle := range cles {
+		r.retirer(cle)
+	}
+}
+
+// purger retire les handshakes jamais terminés
+func (r *registre) purger() {
+	r.mu.Lock()
+	var abandonnees []string
+	for cle, c := range r.conns {
+		if !c.lance && c.temps().maintenant().Sub(c.debut) > dureeHandshake {
+			abandonnees = append(abandonnees, cle)
+		}
+	}
+	r.mu.Unlock()
+	for _, cle := range abandonnees {
+		r.retirer(cle)
+	}
+}
+
+// occupe renvoie la raison pour laquelle une nouvelle connexion de ip dépasserait les limites, "" sinon
+func (r *registre) occupe(ip netip.Addr, limites *regles) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limites.maxTotal > 0 && len(r.conns) >= limites.maxTotal {
+		return fmt.Sprintf("%d connexions en cours", len(r.conns))
+	}
+	if limites.maxParIP > 0 {
+		parIP := 0
+		for _, c := range r.conns {
+			if ipClient(c.addr) == ip {
+				parIP++
+			}
+		}
+		if parIP >= limites.maxParIP {
+			return fmt.Sprintf("%d connexions en cours depuis %v", parIP, ip)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*-----------------------------FLUX----------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "flux=<nombre>", une connexion porte plusieurs flux
+indépendants. Chaque datagramme du port de données commence alors par le
+numéro de son flux sur 3 chiffres (sous le chiffrement) :
+	<flux sur 3 chiffres><message habituel>
+Chaque flux est une connexion à part entière : demande, META, segments
+numérotés à partir de 1, ACK, fenêtre annoncée et FIN. Un segment perdu ne
+retarde donc que son flux.
+
+Le client choisit les numéros de ses flux, à partir de 1 et jusqu'à 999, sans
+jamais en réutiliser un : un datagramme en retard d'un flux terminé est
+ignoré. Au-delà de 999 fichiers, le client ouvre une nouvelle connexion. Le
+nombre négocié est le nombre de flux ouverts en même temps : le serveur ignore
+la demande d'un flux de plus, que le client renverra. Le flux 000 sert
+au contrôle : "000CLOSE" ferme la connexion. Le serveur la ferme aussi quand
+aucun flux n'est ouvert depuis dureeSession. */
+
+// nombre de flux ouverts en même temps que le serveur accepte au plus
+const fluxMax = 16
+
+// taille du numéro de flux en tête de chaque datagramme
+const enteteFlux = 3
+
+// plus grand numéro de flux qui tient sur enteteFlux chiffres
+const numeroFluxMax = 999
+
+// au-delà, les datagrammes d'un flux qui ne les lit pas assez vite sont perdus
+const tamponFlux = 512
+
+// errFluxFerme est renvoyée par un flux fermé
+var errFluxFerme = errors.New("flux fermé")
+
+// errNumeroFlux est renvoyée pour un numéro de flux qui ne tient pas sur enteteFlux chiffres
+var errNumeroFlux = fmt.Errorf("numéro de flux au-delà de %d", numeroFluxMax)
+
+// surcoutFlux renvoie ce que le numéro de flux ajoute à chaque datagramme
+func surcoutFlux(opts options) int {
+	if opts.a("flux") {
+		return enteteFlux
+	}
+	return 0
+}
+
+// accepterFlux limite le nombre de flux demandé par le client
+func accepterFlux(demande options, acceptees options) {
+	n, err := strconv.Atoi(demande["flux"])
+	if err != nil || n < 1 {
+		delete(acceptees, "flux")
+		return
+	}
+	acceptees["flux"] = strconv.Itoa(min(n, fluxMax))
+}
+
+// nombreFlux renvoie le nombre de flux ouverts en même temps qui a été négocié
+func nombreFlux(opts options) int {
+	n, _ := strconv.Atoi(opts["flux"])
+	return max(n, 1)
+}
+
+// datagramme est un message reçu pour un flux
+type datagramme struct {
+	donnees []byte
+	addr    net.Addr
+}
+
+// multiplexeur répartit les datagrammes de la socket de données entre les flux
+type multiplexeur struct {
+	conn     net.PacketConn
+	pair     *net.UDPAddr
+	mu       sync.Mutex
+	flux     map[int]*flux //flux ouverts
+	termines map[int]bool  //flux fermés : leurs datagrammes en retard sont ignorés
+	accepter int           //nombre de flux que le pair peut ouvrir en même temps
+	nouveaux chan *flux    //flux ouverts par le pair
+	controle chan string   //messages du flux 000
+	fini     chan struct{} //la socket de données est fermée
+	err      error
+	h        horloge //horloge de la connexion : échéances de lecture des flux
+}
+
+// multiplexer lit tous les datagrammes de conn venant de pair. Avec accepter > 0,
+// un numéro inconnu ouvre un nouveau flux (côté serveur), tant que moins de
+// accepter flux sont ouverts. Les échéances des flux sont comptées sur h.
+func multiplexer(conn net.PacketConn, pair *net.UDPAddr, accepter int, h horloge) *multiplexeur {
+	m := &multiplexeur{
+		conn:     conn,
+		pair:     pair,
+		accepter: accepter,
+		flux:     make(map[int]*flux),
+		termines: make(map[int]bool),
+		controle: make(chan string, 1),
+		fini:     make(chan struct{}),
+		h:        h,
+	}
+	if accepter > 0 {
+		m.nouveaux = make(chan *flux, accepter)
+	}
+	go m.repartir()
+	return m
+}
+
+// repartir distribue les datagrammes reçus jusqu'à la fermeture de la socket
+func (m *multiplexeur) repartir() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			m.err = err
+			close(m.fini)
+			return
+		}
+		if !memeAdresse(from, m.pair) || n < enteteFlux {
+			continue
+		}
+		numero, err := strconv.Atoi(string(buf[:enteteFlux]))
+		if err != nil {
+			continue
+		}
+		message := append([]byte(nil), buf[enteteFlux:n]...)
+		if numero == 0 {
+			select {
+			case m.controle <- nettoyer(message):
+			default:
+			}
+			continue
+		}
+		if f := m.trouver(numero); f != nil {
+			select {
+			case f.recus <- datagramme{message, from}:
+			default: //le flux ne suit pas : comme si le datagramme s'était perdu
+			}
+		}
+	}
+}
+
+// trouver renvoie le flux numero, en l'ouvrant si le pair peut en ouvrir
+func (m *multiplexeur) trouver(numero int) *flux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.flux[numero]; ok {
+		return f
+	}
+	if m.nouveaux == nil || m.termines[numero] {
+		return nil
+	}
+	if len(m.flux) >= m.accepter {
+		return nil //plus que le nombre négocié : le client renverra sa demande
+	}
+	f := m.nouveauFlux(numero)
+	select {
+	case m.nouveaux <- f:
+		return f
+	default: //trop de flux en attente : le client renverra sa demande
+		delete(m.flux, numero)
+		return nil
+	}
+}
+
+// ouvrir crée le flux numero (côté client)
+func (m *multiplexeur) ouvrir(numero int) (*flux, error) {
+	if numero < 1 || numero > numeroFluxMax {
+		return nil, errNumeroFlux
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nouveauFlux(numero), nil
+}
+
+// nouveauFlux enregistre le flux numero (verrou pris)
+func (m *multiplexeur) nouveauFlux(numero int) *flux {
+	f := &flux{m: m, numero: numero, recus: make(chan datagramme, tamponFlux), ferme: make(chan struct{})}
+	m.flux[numero] = f
+	return f
+}
+
+// ouverts renvoie le nombre de flux ouverts
+func (m *multiplexeur) ouverts() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.flux)
+}
+
+// fermer envoie CLOSE sur le flux de contrôle (côté client)
+func (m *multiplexeur) fermer() error {
+	_, err := m.conn.WriteTo(fmt.Appendf(nil, "%03dCLOSE", 0), m.pair)
+	return err
+}
+
+// echeanceLecture est l'échéance de lecture d'une socket qui lit dans un canal :
+// la changer réveille les lectures en cours, qui réarment leur délai
+type echeanceLecture struct {
+	mu     sync.Mutex
+	date   time.Time
+	change chan struct{} //fermé au prochain changement
+}
+
+func (e *echeanceLecture) fixer(t time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.date = t
+	if e.change != nil {
+		close(e.change)
+		e.change = nil
+	}
+}
+
+// armer renvoie le canal fermé à l'échéance, comptée sur h (nil s'il n'y en a
+// pas), celui qui est fermé si elle change, et de quoi arrêter le délai
+func (e *echeanceLecture) armer(h horloge) (<-chan struct{}, <-chan struct{}, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.change == nil {
+		e.change = make(chan struct{})
+	}
+	if e.date.IsZero() {
+		return nil, e.change, func() {}
+	}
+	delai := make(chan struct{})
+	reste := e.date.Sub(h.maintenant())
+	if reste <= 0 {
+		close(delai)
+		return delai, e.change, func() {}
+	}
+	//le délai est attendu sur un réveil de h : l'arrêter, c'est donner le réveil
+	r := h.nouveauReveil()
+	h.lancer(func() {
+		if !r.attendre(reste) {
+			close(delai)
+		}
+	})
+	return delai, e.change, r.donner
+}
+
+// flux est un flux de la connexion, utilisable comme une socket
+type flux struct {
+	m        *multiplexeur
+	numero   int
+	recus    chan datagramme
+	ferme    chan struct{}
+	echeance echeanceLecture
+	fermer   sync.Once
+}
+
+func (f *flux) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		delai, change, arreter := f.echeance.armer(f.m.h)
+		select {
+		case d := <-f.recus:
+			arreter()
+			return copy(b, d.donnees), d.addr, nil
+		case <-delai:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-change: //nouvelle échéance : on réarme le délai
+		case <-f.ferme:
+			arreter()
+			return 0, nil, errFluxFerme
+		case <-f.m.fini:
+			arreter()
+			return 0, nil, f.m.err
+		}
+		arreter()
+	}
+}
+
+func (f *flux) WriteTo(b []byte, addr net.Addr) (int, error) {
+	datagramme := make([]byte, enteteFlux, enteteFlux+len(b))
+	copy(datagramme, fmt.Sprintf("%03d", f.numero))
+	if _, err := f.m.conn.WriteTo(append(datagramme, b...), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ferme le flux seulement : la socket de données sert aux autres
+func (f *flux) Close() error {
+	f.fermer.Do(func() {
+		f.m.mu.Lock()
+		delete(f.m.flux, f.numero)
+		f.m.termines[f.numero] = true
+		f.m.mu.Unlock()
+		close(f.ferme)
+	})
+	return nil
+}
+
+func (f *flux) LocalAddr() net.Addr { return f.m.conn.LocalAddr() }
+
+func (f *flux) SetDeadline(t time.Time) error { return f.SetReadDeadline(t) }
+
+func (f *flux) SetReadDeadline(t time.Time) error {
+	f.echeance.fixer(t)
+	return nil
+}
+
+func (f *flux) SetWriteDeadline(t time.Time) error { return nil }
+
+// servirFlux sert avec traiter chaque flux ouvert par le client, chacun dans sa
+// goroutine, jusqu'à CLOSE ou dureeSession sans flux ouvert
+func servirFlux(c *connexion, traiter func(*connexion)) {
+	m := multiplexer(c.conn, c.addr, nombreFlux(c.options), c.temps())
+	var enCours sync.WaitGroup
+	defer enCours.Wait()
+	defer c.conn.Close() //les flux encore ouverts s'arrêtent
+
+	inactivite := time.NewTicker(dureeSession)
+	defer inactivite.Stop()
+	actif := false
+	for {
+		select {
+		case f := <-m.nouveaux:
+			//Une demande est arrivée sur le port annoncé dans le SYN-ACK : le client est joignable
+			c.budget.valider()
+			cf := &connexion{conn: f, addr: c.addr, options: c.options, racine: c.racine, depotMax: c.depotMax, identite: c.identite, budget: c.budget, debut: c.debut, horloge: c.horloge, journal: c.log().With("flux", f.numero), trace: c.trace.pourFlux(f.numero)}
+			enCours.Go(func() { traiter(cf) })
+			actif = true
+		case message := <-m.controle:
+			if message == "CLOSE" {
+				return
+			}
+		case <-inactivite.C:
+			if !actif && m.ouverts() == 0 {
+				return
+			}
+			actif = false
+		case <-m.fini:
+			return
+		}
+	}
+}
+
+// errSansFlux est renvoyée quand le serveur n'a pas accepté l'option "flux"
+var errSansFlux = errors.New("le serveur ne gère pas les flux")
+
+// telechargerFlux récupère plusieurs fichiers en même temps avec une seule
+// connexion, un flux par fichier et au plus nombre flux ouverts à la fois
+// (une nouvelle connexion tous les numeroFluxMax fichiers).
+// Elle renvoie les fichiers arrivés corrompus, à redemander.
+func telechargerFlux(t telechargement, fichiers []string, nombre int) ([]string, error) {
+	var corrompus []string
+	for len(fichiers) > 0 {
+		lot := fichiers[:min(len(fichiers), numeroFluxMax)]
+		fichiers = fichiers[len(lot):]
+		c, err := telechargerLot(t, lot, nombre)
+		corrompus = append(corrompus, c...)
+		if err != nil {
+			return corrompus, err
+		}
+	}
+	return corrompus, nil
+}
+
+// telechargerLot récupère au plus numeroFluxMax fichiers sur une connexion
+func telechargerLot(t telechargement, fichiers []string, nombre int) ([]string, error) {
+	t.options = maps.Clone(t.options)
+	t.options["flux"] = strconv.Itoa(nombre)
+	conn, dataConn, donnees, opts, err := connecter(t)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if !opts.a("flux") {
+		return nil, errSansFlux
+	}
+	m := multiplexer(dataConn, donnees, 0, horlogeSysteme{})
+	defer m.fermer()
+
+	var (
+		mu        sync.Mutex
+		corrompus []string
+		erreur    error
+		enCours   sync.WaitGroup
+	)
+	places := make(chan struct{}, nombreFlux(opts))
+	for i, fichier := range fichiers {
+		places <- struct{}{}
+		f, err := m.ouvrir(i + 1)
+		if err != nil {
+			mu.Lock()
+			erreur = err
+			mu.Unlock()
+			<-places
+			break
+		}
+		enCours.Go(func() {
+			defer func() { <-places }()
+			defer f.Close()
+			c := &connexion{conn: f, addr: donnees, options: opts}
+			//le nom du fichier est terminé par un octet nul, comme pour client1
+			demande := append([]byte(fichier), 0)
+			if _, err := f.WriteTo(demande, donnees); err != nil {
+				mu.Lock()
+				erreur = err
+				mu.Unlock()
+				return
+			}
+			sortie := "copy_" + filepath.Base(fichier)
+			err := recevoirFichier(c, sortie, demande, reglagesReception{max: t.max})
+			if err == nil {
+				fmt.Println(fichier, ": reçu")
+				return
+			}
+			fmt.Println(fichier, ":", err)
+			os.Remove(sortie) //on ne garde jamais un fichier incomplet
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, errIntegrite):
+				corrompus = append(corrompus, fichier)
+			case !errors.Is(err, errRefus):
+				erreur = err
+			}
+		})
+	}
+	enCours.Wait()
+	return corrompus, erreur
+}
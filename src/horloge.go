@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------------HORLOGE---------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Le moteur d'envoi (envoyer, recherche de PMTU, META, attente du FIN et
+des demandes de la session), ses statistiques, ses traces et la réception
+(handshake du client, recevoir, les réponses d'un dépôt, les échéances de
+lecture des flux) ne lisent l'heure, n'attendent et ne lancent de goroutine
+qu'à travers l'horloge de leur connexion, et n'échangent de datagrammes
+qu'à travers c.conn ; côté serveur, la fenêtre anti-rejeu des nonces suit
+l'horloge du serveur. Les serveurs et le client utilisent l'horloge du
+système ; la simulation (simulation_test.go) les remplace par une horloge et
+un réseau virtuels, où le temps n'avance que quand tout le monde attend. */
+
+// horloge donne l'heure au moteur d'envoi, le fait attendre et lance ses goroutines
+type horloge interface {
+	maintenant() time.Time
+	dormir(d time.Duration)
+	lancer(f func())
+	nouveauReveil() reveil
+}
+
+// reveil réveille une goroutine de l'horloge qui l'attend ; un réveil donné quand
+// personne n'attend est gardé (une seule fois) pour la prochaine attente
+type reveil interface {
+	donner()
+	//attendre renvoie false si le réveil n'est pas venu dans le délai (d < 0 : sans limite)
+	attendre(d time.Duration) bool
+}
+
+// horlogeSysteme est l'horloge réelle
+type horlogeSysteme struct{}
+
+func (horlogeSysteme) maintenant() time.Time  { return time.Now() }
+func (horlogeSysteme) dormir(d time.Duration) { time.Sleep(d) }
+func (horlogeSysteme) lancer(f func())        { go f() }
+func (horlogeSysteme) nouveauReveil() reveil  { return make(reveilSysteme, 1) }
+
+// reveilSysteme est le réveil de l'horloge réelle
+type reveilSysteme chan struct{}
+
+func (g reveilSysteme) donner() {
+	select {
+	case g <- struct{}{}:
+	default: //déjà donné
+	}
+}
+
+func (g reveilSysteme) attendre(d time.Duration) bool {
+	if d < 0 {
+		<-g
+		return true
+	}
+	delai := time.NewTimer(d)
+	defer delai.Stop()
+	select {
+	case <-g:
+		return true
+	case <-delai.C:
+		return false
+	}
+}
+
+// temps renvoie l'horloge de la connexion (celle du système si aucune n'est donnée)
+func (c *connexion) temps() horloge {
+	if c.horloge == nil {
+		return horlogeSysteme{}
+	}
+	return c.horloge
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------VERIFICATION DE BOUT EN BOUT------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "sha256", le serveur calcule l'empreinte du fichier avant
+de l'envoyer et l'envoie avec le FIN ("FIN hash=sha256:<hex>")
+ainsi que dans META si "meta" est aussi négocié. Le client calcule
+l'empreinte de ce qu'il a écrit et refuse le fichier si elles diffèrent. */
+
+// errIntegrite est renvoyée quand le fichier reçu ne correspond pas à celui envoyé
+var errIntegrite = errors.New("fichier corrompu")
+
+// nouvelleEmpreinte renvoie le calcul d'empreinte à utiliser, nil si "sha256" n'est pas négocié
+func nouvelleEmpreinte(opts options) hash.Hash {
+	if !opts.a("sha256") {
+		return nil
+	}
+	return sha256.New()
+}
+
+// formaterEmpreinte donne l'empreinte sous la forme "sha256:<hex>" utilisée dans META et FIN
+func formaterEmpreinte(h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// messageFin construit le FIN, suivi de l'empreinte du fichier si elle a été calculée
+func messageFin(empreinte string) []byte {
+	if empreinte == "" {
+		return []byte("FIN")
+	}
+	return []byte("FIN hash=" + empreinte)
+}
+
+// lireFin renvoie l'empreinte annoncée dans un FIN, vide s'il n'y en a pas
+func lireFin(message string) string {
+	champs := strings.Fields(message)
+	if len(champs) == 0 {
+		return ""
+	}
+	return lireOptions(champs[1:])["hash"]
+}
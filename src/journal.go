@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------------JOURNAL---------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Le journal passe par log/slog, sur la sortie d'erreur. Chaque connexion a
+son propre journal qui ajoute l'adresse du client et le port de données (et
+le fichier, le numéro de séquence... selon le message). Niveaux :
+	paquets  chaque segment, ACK ou message reçu (très bavard)
+	debug    étapes du handshake et des transferts
+	info     (par défaut) début et fin des connexions
+	warn, error
+Le niveau se choisit avec -journal et les clients dont on veut voir les
+paquets sans tout voir avec -suivre <ip>[,<ip>...]. Les deux se changent
+pendant que le serveur tourne, sur l'adresse des métriques, depuis la machine
+du serveur seulement :
+	curl '<adresse>/journal?niveau=debug&suivre=192.0.2.2' */
+
+// niveau des messages de chaque paquet, sous debug
+const niveauPaquets = slog.LevelDebug - 4
+
+// niveau du journal, changeable à tout moment
+var niveauJournal = new(slog.LevelVar)
+
+// clients dont on trace les paquets quel que soit le niveau
+var clientsSuivis atomic.Pointer[[]netip.Addr]
+
+// journal est le journal du programme ; journalClient en dérive celui d'une connexion
+var journal = slog.New(&filtreJournal{Handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	Level:       niveauPaquets, //le tri se fait dans filtreJournal
+	ReplaceAttr: nommerNiveau,
+})})
+
+// filtreJournal laisse passer les messages du niveau choisi, et tous ceux d'un client suivi
+type filtreJournal struct {
+	slog.Handler
+	client netip.Addr
+}
+
+func (f *filtreJournal) Enabled(_ context.Context, niveau slog.Level) bool {
+	return niveau >= niveauJournal.Level() || (niveau >= niveauPaquets && suivi(f.client))
+}
+
+func (f *filtreJournal) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &filtreJournal{Handler: f.Handler.WithAttrs(attrs), client: f.client}
+}
+
+func (f *filtreJournal) WithGroup(nom string) slog.Handler {
+	return &filtreJournal{Handler: f.Handler.WithGroup(nom), client: f.client}
+}
+
+// suivi indique si les paquets du client sont tracés
+func suivi(client netip.Addr) bool {
+	liste := clientsSuivis.Load()
+	return client.IsValid() && liste != nil && slices.Contains(*liste, client)
+}
+
+// tracer indique si un message de niveau paquets venant de addr serait écrit
+func tracer(addr *net.UDPAddr) bool {
+	return niveauJournal.Level() <= niveauPaquets || suivi(ipClient(addr))
+}
+
+// journalClient renvoie le journal d'une connexion avec le client addr
+func journalClient(addr *net.UDPAddr) *slog.Logger {
+	f := journal.Handler().(*filtreJournal)
+	return slog.New(&filtreJournal{Handler: f.Handler.WithAttrs([]slog.Attr{slog.String("client", addr.String())}), client: ipClient(addr)})
+}
+
+// log renvoie le journal de la connexion (celui du programme côté client)
+func (c *connexion) log() *slog.Logger {
+	if c.journal == nil {
+		return journal
+	}
+	return c.journal
+}
+
+// nommerNiveau affiche "PAQUETS" plutôt que "DEBUG-4"
+func nommerNiveau(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && a.Value.Any() == niveauPaquets {
+		a.Value = slog.StringValue("PAQUETS")
+	}
+	return a
+}
+
+// reglerJournal change le niveau du journal ("paquets", "debug", "info", "warn", "error")
+func reglerJournal(niveau string) error {
+	if strings.EqualFold(niveau, "paquets") {
+		niveauJournal.Set(niveauPaquets)
+		return nil
+	}
+	var n slog.Level
+	if err := n.UnmarshalText([]byte(niveau)); err != nil {
+		return fmt.Errorf("niveau de journal inconnu : %s", niveau)
+	}
+	niveauJournal.Set(n)
+	return nil
+}
+
+// suivre remplace la liste des clients dont on trace les paquets ("" : aucun)
+func suivre(liste string) error {
+	var clients []netip.Addr
+	for _, champ := range strings.Split(liste, ",") {
+		if champ = strings.TrimSpace(champ); champ == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(champ)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, ip.Unmap())
+	}
+	clientsSuivis.Store(&clients)
+	return nil
+}
+
+// pageJournal règle le journal depuis HTTP (?niveau=...&suivre=...) et affiche les réglages
+func pageJournal(w http.ResponseWriter, r *http.Request) {
+	if niveau := r.FormValue("niveau"); niveau != "" {
+		if err := reglerJournal(niveau); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.Form["suivre"]; ok {
+		if err := suivre(r.FormValue("suivre")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	niveau := niveauJournal.Level().String()
+	if niveauJournal.Level() == niveauPaquets {
+		niveau = "PAQUETS"
+	}
+	var suivis []string
+	if liste := clientsSuivis.Load(); liste != nil {
+		for _, ip := range *liste {
+			suivis = append(suivis, ip.String())
+		}
+	}
+	fmt.Fprintf(w, "niveau=%s suivre=%s\n", niveau, strings.Join(suivis, ","))
+}
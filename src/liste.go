@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*------------------------LISTE ET STAT------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "liste", le client peut demander à la place d'un nom :
+	LIST <dossier>\0   (dossier vide : la racine servie)
+	STAT <nom>\0
+Le serveur répond par un document JSON, envoyé exactement comme un fichier
+(META, segments, FIN), ce qui permet des dossiers de toute taille :
+	LIST : {"dossier":"<dossier>","entrees":[{"nom":..,"taille":..,"mtime":..,"dossier":true}, ...]}
+	STAT : {"nom":..,"taille":..,"mtime":..}
+mtime est une date Unix ; "dossier" n'apparaît que pour les dossiers. En cas
+d'erreur (fichier absent, droits), il répond "DENY <raison>". */
+
+// entree décrit un fichier ou un dossier servi
+type entree struct {
+	Nom     string `json:"nom"`
+	Taille  int64  `json:"taille"`
+	Mtime   int64  `json:"mtime"`
+	Dossier bool   `json:"dossier,omitempty"`
+}
+
+// listeDossier est la réponse à LIST
+type listeDossier struct {
+	Dossier string   `json:"dossier"`
+	Entrees []entree `json:"entrees"`
+}
+
+func nouvelleEntree(nom string, fi fs.FileInfo) entree {
+	return entree{Nom: nom, Taille: fi.Size(), Mtime: fi.ModTime().Unix(), Dossier: fi.IsDir()}
+}
+
+// document est une réponse construite par le serveur, envoyée comme un fichier
+type document struct {
+	*bytes.Reader
+	nom  string
+	date time.Time
+}
+
+func (d *document) Stat() (fs.FileInfo, error) { return d, nil }
+func (d *document) Name() string               { return d.nom }
+func (d *document) Mode() fs.FileMode          { return 0444 }
+func (d *document) ModTime() time.Time         { return d.date }
+func (d *document) IsDir() bool                { return false }
+func (d *document) Sys() any                   { return nil }
+
+// decrire construit la réponse à LIST ou STAT, sans sortir du dossier servi de c,
+// datée par l'horloge de c
+func decrire(c *connexion, commande, nom string) (*document, error) {
+	racine := c.racine
+	chemin := nettoyerChemin(nom)
+	if chemin == "" {
+		chemin = "."
+	}
+	var reponse any
+	switch commande {
+	case "STAT":
+		fi, err := racine.Stat(chemin)
+		if err != nil {
+			return nil, err
+		}
+		reponse = nouvelleEntree(path.Base(chemin), fi)
+	case "LIST":
+		dossier, err := racine.Open(chemin)
+		if err != nil {
+			return nil, err
+		}
+		defer dossier.Close()
+		contenu, err := dossier.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+		liste := listeDossier{Dossier: nom, Entrees: []entree{}}
+		for _, e := range contenu {
+			fi, err := e.Info()
+			if err != nil {
+				continue //supprimé entre-temps
+			}
+			liste.Entrees = append(liste.Entrees, nouvelleEntree(e.Name(), fi))
+		}
+		slices.SortFunc(liste.Entrees, func(a, b entree) int { return strings.Compare(a.Nom, b.Nom) })
+		reponse = liste
+	default:
+		return nil, fmt.Errorf("commande inconnue : %s", commande)
+	}
+	contenu, err := json.Marshal(reponse)
+	if err != nil {
+		return nil, err
+	}
+	return &document{Reader: bytes.NewReader(contenu), nom: commande, date: c.temps().maintenant()}, nil
+}
+
+// consulter envoie LIST ou STAT au serveur et renvoie sa réponse JSON
+func consulter(t telechargement, commande, nom string) ([]byte, error) {
+	t.options = maps.Clone(t.options)
+	t.options["liste"] = ""
+	conn, dataConn, donnees, opts, err := connecter(t)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if !opts.a("liste") {
+		return nil, fmt.Errorf("%v ne gère pas LIST et STAT", donnees)
+	}
+
+	//la réponse arrive comme un fichier : on la reçoit dans un fichier temporaire
+	reponse, err := os.CreateTemp("", "reponse-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(reponse.Name())
+	defer reponse.Close()
+
+	demande := []byte(commande + " " + nom + "\x00")
+	if _, err := dataConn.WriteTo(demande, donnees); err != nil {
+		return nil, err
+	}
+	c := &connexion{conn: dataConn, addr: donnees, options: opts}
+	if err := recevoir(c, reponse, demande, reglagesReception{}); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(reponse.Name())
+}
+
+// afficherListe affiche la réponse à LIST ou STAT, une entrée par ligne
+func afficherListe(commande string, reponse []byte) error {
+	var entrees []entree
+	if commande == "LIST" {
+		var liste listeDossier
+		if err := json.Unmarshal(reponse, &liste); err != nil {
+			return err
+		}
+		entrees = liste.Entrees
+	} else {
+		var e entree
+		if err := json.Unmarshal(reponse, &e); err != nil {
+			return err
+		}
+		entrees = []entree{e}
+	}
+	for _, e := range entrees {
+		if e.Dossier {
+			e.Nom += "/"
+		}
+		fmt.Printf("%12d  %s  %s\n", e.Taille, time.Unix(e.Mtime, 0).Format(time.DateTime), e.Nom)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*--------------------------METRIQUES--------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec -metriques <adresse>, le serveur répond sur http://<adresse>/metrics
+au format texte de Prometheus. Les compteurs sont tenus par le serveur au fil
+des handshakes et des transferts (octets, renvois et délais expirés à chaque
+segment, pour qu'un long envoi se voie avancer) ; les jauges (connexions,
+ports) sont relevées au moment de la lecture. La page /journal, qui change le
+journal, ne répond qu'aux requêtes venues de la machine elle-même. */
+
+// serie est une métrique Prometheus, éventuellement découpée selon une étiquette
+type serie struct {
+	nom       string
+	genre     string // "counter" ou "gauge"
+	aide      string
+	etiquette string // nom de l'étiquette, "" s'il n'y en a pas
+	mu        sync.Mutex
+	valeurs   map[string]float64 // par valeur de l'étiquette
+}
+
+// series dans l'ordre où elles sont affichées
+var series []*serie
+
+func nouvelleSerie(nom, genre, aide, etiquette string) *serie {
+	s := &serie{nom: nom, genre: genre, aide: aide, etiquette: etiquette, valeurs: make(map[string]float64)}
+	series = append(series, s)
+	return s
+}
+
+var (
+	metriqueConnexions  = nouvelleSerie("serveur_connexions_actives", "gauge", "Connexions ouvertes (handshake en cours ou transfert).", "")
+	metriqueHandshakes  = nouvelleSerie("serveur_handshakes_total", "counter", "SYN reçus de nouveaux clients, selon la réponse.", "resultat")
+	metriqueTransferts  = nouvelleSerie("serveur_transferts_total", "counter", "Transferts terminés (envois et dépôts).", "resultat")
+	metriqueOctets      = nouvelleSerie("serveur_octets_envoyes_total", "counter", "Octets de segments envoyés, renvois compris.", "")
+	metriqueRenvois     = nouvelleSerie("serveur_renvois_total", "counter", "Segments envoyés plus d'une fois.", "")
+	metriqueRTO         = nouvelleSerie("serveur_rto_total", "counter", "Délais de retransmission expirés.", "")
+	metriquePorts       = nouvelleSerie("serveur_ports_donnees_utilises", "gauge", "Ports de données ouverts.", "")
+	metriquePortsMax    = nouvelleSerie("serveur_ports_donnees_disponibles", "gauge", "Taille de la plage des ports de données.", "")
+	metriquePortsEchecs = nouvelleSerie("serveur_ports_donnees_echecs_total", "counter", "Ports de données qui n'ont pas pu être ouverts.", "")
+	metriqueUtiles      = nouvelleSerie("serveur_octets_utiles_total", "counter", "Octets de fichiers envoyés et acquittés, par scénario.", "scenario")
+	metriqueDureeEnvois = nouvelleSerie("serveur_duree_envois_secondes_total", "counter", "Durée cumulée des envois réussis, par scénario (débit = utiles / durée).", "scenario")
+)
+
+// ajouter augmente la série pour une valeur de l'étiquette ("" sans étiquette)
+func (s *serie) ajouter(valeur string, n float64) {
+	s.mu.Lock()
+	s.valeurs[valeur] += n
+	s.mu.Unlock()
+}
+
+// fixer donne sa valeur à une jauge
+func (s *serie) fixer(valeur string, n float64) {
+	s.mu.Lock()
+	s.valeurs[valeur] = n
+	s.mu.Unlock()
+}
+
+// ecrire affiche la série au format texte de Prometheus
+func (s *serie) ecrire(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.nom, s.aide, s.nom, s.genre)
+	if s.etiquette == "" {
+		fmt.Fprintf(w, "%s %s\n", s.nom, formaterValeur(s.valeurs[""]))
+		return
+	}
+	valeurs := make([]string, 0, len(s.valeurs))
+	for v := range s.valeurs {
+		valeurs = append(valeurs, v)
+	}
+	slices.Sort(valeurs)
+	for _, v := range valeurs {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", s.nom, s.etiquette, strconv.Quote(v), formaterValeur(s.valeurs[v]))
+	}
+}
+
+func formaterValeur(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// compterHandshake note la réponse faite au SYN d'un nouveau client
+func compterHandshake(resultat string) {
+	metriqueHandshakes.ajouter(resultat, 1)
+}
+
+// compterTransfert note la fin d'un transfert ; stats est nil pour un dépôt (les
+// octets, renvois et délais expirés sont comptés pendant l'envoi par statistiques)
+func compterTransfert(stats *statistiques, scenario string, err error) {
+	if err != nil {
+		metriqueTransferts.ajouter("echoue", 1)
+	} else {
+		metriqueTransferts.ajouter("reussi", 1)
+	}
+	if stats == nil {
+		return
+	}
+	b := stats.bilan()
+	if err == nil {
+		metriqueUtiles.ajouter(scenario, float64(b.Utiles))
+		metriqueDureeEnvois.ajouter(scenario, b.Duree)
+	}
+}
+
+// localement ne laisse passer que les requêtes venues de la machine elle-même :
+// quiconque peut lire les métriques ne doit pas pouvoir remplir le disque de journaux
+func localement(page http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ap, err := netip.ParseAddrPort(r.RemoteAddr); err != nil || !ap.Addr().Unmap().IsLoopback() {
+			http.Error(w, "réservé aux requêtes locales", http.StatusForbidden)
+			return
+		}
+		page(w, r)
+	}
+}
+
+// servirMetriques lance le serveur HTTP des métriques (et du réglage du journal) ;
+// jauges met à jour les jauges juste avant chaque lecture
+func servirMetriques(adresse string, jauges func()) {
+	metriquePortsMax.fixer("", portMax-portMin)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/journal", localement(pageJournal))
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		jauges()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, s := range series {
+			s.ecrire(w)
+		}
+	})
+	serveur := &http.Server{Addr: adresse, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := serveur.ListenAndServe(); err != nil {
+			journal.Error("métriques indisponibles", "adresse", adresse, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------TAILLE DES SEGMENTS ET RECHERCHE DE PMTU------- */
+/*-------------------------------------------------------------- */
+
+/* Sans option, les datagrammes font 1500 octets comme à l'origine.
+
+"mss=<octets>" : le client annonce le plus grand datagramme UDP qu'il accepte
+(par défaut la MTU de son interface moins les en-têtes IP et UDP). Le serveur
+répond avec le minimum de cette valeur, de la MTU de son interface vers le
+client et de sa propre limite (-mss). Les datagrammes font alors au plus cette
+taille, chiffrement compris.
+
+"pmtud" : recherche de la MTU du chemin par la couche transport (RFC 8899).
+Le serveur commence à tailleBase octets (au plus mss) et envoie en parallèle
+du transfert des sondes "PMTU<taille sur 6 chiffres>" complétées par des zéros
+jusqu'à la taille essayée, que le client acquitte par "ACKPMTU<octets reçus
+sur 6 chiffres>". Une sonde acquittée fait grandir les segments découpés
+ensuite ; une sonde perdue essaisSonde fois fait baisser la borne haute de la
+recherche (dichotomie entre la plus grande taille confirmée et mss). Si un
+segment plus grand que tailleBase est perdu pertesTrouNoir fois de suite, le
+chemin a changé : on revient à tailleBase et la recherche reprend en dessous
+de la taille perdue. Les segments déjà découpés gardent leur taille. */
+
+const (
+	tailleBase     = 1200  //taille sûre des datagrammes en attendant les sondes (RFC 8899)
+	tailleMin      = 512   //en dessous, la taille demandée par le client est ignorée
+	mssMax         = 65507 //plus grand datagramme UDP sur IPv4
+	essaisSonde    = 3
+	delaiSonde     = 200 * time.Millisecond
+	pasRecherche   = 16 //la recherche s'arrête quand l'intervalle est plus petit
+	pertesTrouNoir = 3
+)
+
+// accepterMss fixe la taille maximale des datagrammes d'un client : le minimum de ce qu'il
+// accepte, de la MTU de l'interface qui mène à lui et de la limite du serveur (0 : pas de limite)
+func accepterMss(demande options, acceptees options, client *net.UDPAddr, limite int) {
+	mss, err := strconv.Atoi(demande["mss"])
+	if err != nil {
+		return
+	}
+	mss = min(mss, mssMax, mtuVers(client))
+	if limite > 0 {
+		mss = min(mss, limite)
+	}
+	if mss >= tailleMin {
+		acceptees["mss"] = strconv.Itoa(mss)
+	}
+}
+
+// tailleInitiale renvoie la taille des premiers datagrammes du transfert
+func tailleInitiale(opts options) int {
+	if opts.a("pmtud") {
+		return min(tailleBase, tailleDatagramme(opts))
+	}
+	return tailleDatagramme(opts)
+}
+
+// decoupage découpe le fichier en segments au fur et à mesure de l'envoi, à la taille du moment
+type decoupage struct {
+	mu      sync.Mutex
+	decoupe segmenteur
+	opts    options
+	entete  int
+	taille  int      //taille des prochains datagrammes, chiffrement compris
+	base    int      //numéro du segment qui précède le premier (session)
+	paquets [][]byte //segments déjà découpés : le segment n est paquets[n-1]
+	fin     bool     //tout le fichier a été découpé
+	err     error    //erreur de lecture du fichier
+}
+
+func nouveauDecoupage(r io.Reader, opts options, base int) *decoupage {
+	return &decoupage{decoupe: nouveauSegmenteur(r, opts), opts: opts, entete: tailleEntete(opts), taille: tailleInitiale(opts), base: base}
+}
+
+// construire découpe les segments jusqu'au numéro num (verrou pris)
+func (d *decoupage) construire(num int) {
+	for len(d.paquets) < num && !d.fin {
+		packet := make([]byte, d.taille-surcoutDatagramme(d.opts))
+
+		//on ajoute le chunk de données, le paquet est coupé à ce qui a été rempli (dernier paquet)
+		n, err := d.decoupe.remplir(packet[d.entete:])
+		if err != nil {
+			d.err = err
+		}
+		if n == 0 || err != nil {
+			d.fin = true
+			return
+		}
+		packet = packet[:n+d.entete]
+
+		//on ajoute le header en rajoutant les 0 nécessaires
+		copy(packet[0:6], fmt.Sprintf("%06d", d.base+len(d.paquets)+1))
+
+		if d.opts.a("crc32c") {
+			sceller(packet)
+		}
+		d.paquets = append(d.paquets, packet)
+	}
+}
+
+// segment renvoie le segment num, nil s'il est après la fin du fichier
+func (d *decoupage) segment(num int) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.construire(num)
+	if num < 1 || num > len(d.paquets) {
+		return nil
+	}
+	return d.paquets[num-1]
+}
+
+// dernier indique si le segment num est le dernier du fichier (0 pour un fichier vide)
+func (d *decoupage) dernier(num int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.construire(num + 1)
+	return d.fin && num >= len(d.paquets)
+}
+
+// fixerTaille change la taille des segments découpés à partir de maintenant
+func (d *decoupage) fixerTaille(taille int) {
+	d.mu.Lock()
+	d.taille = taille
+	d.mu.Unlock()
+}
+
+func (d *decoupage) erreur() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// sondeur cherche la plus grande taille de datagramme qui passe jusqu'au client
+type sondeur struct {
+	mu        sync.Mutex
+	c         *connexion
+	d         *decoupage
+	h         horloge
+	base      int    //taille sûre, où l'on revient en cas de trou noir
+	confirmee int    //plus grande taille acquittée par le client
+	max       int    //plus grande taille encore possible
+	perdu     int    //numéro du dernier segment perdu
+	pertes    int    //nombre de fois de suite où il a été perdu
+	recue     int    //taille de la dernière sonde acquittée par le client
+	arrete    bool   //le transfert est fini : la recherche s'arrête
+	nouvelles reveil //une sonde a été acquittée, ou la recherche doit s'arrêter
+	termine   reveil //la recherche s'est arrêtée
+}
+
+func nouveauSondeur(c *connexion, d *decoupage) *sondeur {
+	base := tailleInitiale(c.options)
+	h := c.temps()
+	return &sondeur{c: c, d: d, h: h, base: base, confirmee: base, max: tailleDatagramme(c.options), nouvelles: h.nouveauReveil(), termine: h.nouveauReveil()}
+}
+
+// lancer démarre la recherche sur l'horloge de la connexion
+func (s *sondeur) lancer() {
+	s.h.lancer(func() {
+		defer s.termine.donner()
+		s.rechercher()
+	})
+}
+
+// arreter arrête la recherche et attend qu'elle soit terminée
+func (s *sondeur) arreter() {
+	s.mu.Lock()
+	s.arrete = true
+	s.mu.Unlock()
+	s.nouvelles.donner()
+	s.termine.attendre(-1)
+}
+
+func (s *sondeur) fini() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.arrete
+}
+
+// rechercher envoie des sondes jusqu'à ce que la recherche soit arrêtée
+func (s *sondeur) rechercher() {
+	for !s.fini() {
+		cible := s.cible()
+		if cible == 0 {
+			//recherche terminée : on attend un éventuel trou noir
+			s.nouvelles.attendre(delaiSonde)
+			continue
+		}
+		ok := s.sonder(cible)
+		s.mu.Lock()
+		if s.arrete {
+			s.mu.Unlock()
+			return
+		}
+		if ok && cible > s.confirmee {
+			s.confirmee = cible
+			s.d.fixerTaille(cible)
+		} else if !ok && cible <= s.max {
+			s.max = cible - 1
+		}
+		s.mu.Unlock()
+	}
+}
+
+// cible renvoie la prochaine taille à essayer, 0 si la recherche est finie
+func (s *sondeur) cible() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max-s.confirmee < pasRecherche {
+		return 0
+	}
+	return (s.confirmee + s.max + 1) / 2
+}
+
+// sonder envoie une sonde de la taille voulue (chiffrement compris) et attend son acquittement
+func (s *sondeur) sonder(taille int) bool {
+	sonde := make([]byte, taille-surcoutDatagramme(s.c.options))
+	copy(sonde, fmt.Sprintf("PMTU%06d", taille))
+	s.mu.Lock()
+	s.recue = 0
+	s.mu.Unlock()
+	for essai := 0; essai < essaisSonde; essai++ {
+		if _, err := s.c.conn.WriteTo(sonde, s.c.addr); err != nil {
+			return false //trop grand pour l'interface
+		}
+		echeance := s.h.maintenant().Add(delaiSonde)
+		for reste := delaiSonde; reste > 0; reste = echeance.Sub(s.h.maintenant()) {
+			if !s.nouvelles.attendre(reste) {
+				break
+			}
+			s.mu.Lock()
+			ok, arrete := s.recue == len(sonde), s.arrete
+			s.mu.Unlock()
+			if ok || arrete {
+				return ok
+			}
+		}
+	}
+	return false
+}
+
+// reponse transmet l'acquittement d'une sonde ("ACKPMTU<octets reçus>")
+func (s *sondeur) reponse(recue int) {
+	s.mu.Lock()
+	s.recue = recue
+	s.mu.Unlock()
+	s.nouvelles.donner()
+}
+
+// perte signale que le segment num, de la taille donnée (chiffrement compris), a été
+// perdu : après pertesTrouNoir pertes de suite on revient à la taille de base
+func (s *sondeur) perte(num int, taille int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if taille <= s.base {
+		return
+	}
+	if num != s.perdu {
+		s.perdu, s.pertes = num, 0
+	}
+	s.pertes++
+	if s.pertes < pertesTrouNoir {
+		return
+	}
+	s.pertes = 0
+	s.confirmee = s.base
+	s.max = min(s.max, taille-1)
+	s.d.fixerTaille(s.base)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------EXTENSIONS DU PROTOCOLE------------------ */
+/*-------------------------------------------------------------- */
+
+/* Les clients fournis (client1, client2) envoient un simple "SYN" et ne
+connaissent que le format d'origine. Un client qui veut plus ajoute ses
+options dans le SYN ("SYN meta ...") ; le serveur répond par les options
+qu'il accepte à la suite du port ("SYN-ACK1024 meta ..."). Sans option dans
+le SYN, le serveur se comporte exactement comme avant. */
+
+// options négociées pendant le handshake : clé -> valeur ("" si l'option n'a pas de valeur)
+type options map[string]string
+
+// optionsServeur liste les options que le serveur sait gérer
+var optionsServeur = []string{"meta", "sha256", "crc32c", "compression", "pmtud", "rwnd", "put", "session", "flux", "liste", "fec"}
+
+// délai et nombre d'essais pour les messages de contrôle (handshake, META)
+const delaiControle = 500 * time.Millisecond
+const essaisControle = 5
+
+// lireOptions découpe les champs "cle" ou "cle=valeur" qui suivent SYN ou SYN-ACK
+func lireOptions(champs []string) options {
+	opts := make(options)
+	for _, champ := range champs {
+		cle, valeur, _ := strings.Cut(champ, "=")
+		if cle != "" {
+			opts[cle] = valeur
+		}
+	}
+	return opts
+}
+
+// String renvoie les options dans un ordre stable, séparées par des espaces
+func (opts options) String() string {
+	champs := make([]string, 0, len(opts))
+	for cle, valeur := range opts {
+		if valeur == "" {
+			champs = append(champs, cle)
+		} else {
+			champs = append(champs, cle+"="+valeur)
+		}
+	}
+	sort.Strings(champs)
+	return strings.Join(champs, " ")
+}
+
+// a indique si l'option a été négociée
+func (opts options) a(cle string) bool {
+	_, ok := opts[cle]
+	return ok
+}
+
+// accepter ne garde que les options demandées par le client que le serveur connaît
+func accepter(demande options) options {
+	acceptees := make(options)
+	for _, cle := range optionsServeur {
+		valeur, ok := demande[cle]
+		if ok && cle == "compression" {
+			//le serveur choisit un seul algorithme parmi ceux proposés
+			valeur = choisirCompression(valeur)
+			ok = valeur != ""
+		}
+		if ok && cle == "fec" {
+			valeur = choisirFEC(valeur)
+			ok = valeur != ""
+		}
+		if ok {
+			acceptees[cle] = valeur
+		}
+	}
+	return acceptees
+}
+
+// tailleDatagramme renvoie la taille maximale des datagrammes, chiffrement compris :
+// 1500 octets comme à l'origine, ou la taille négociée avec "mss"
+func tailleDatagramme(opts options) int {
+	if mss, err := strconv.Atoi(opts["mss"]); err == nil {
+		return mss
+	}
+	return 1500
+}
+
+// surcoutDatagramme renvoie ce que le chiffrement, le numéro de flux et la place
+// réservée aux parités retirent aux données de chaque datagramme
+func surcoutDatagramme(opts options) int {
+	return surcoutChiffrement(opts) + surcoutFlux(opts) + surcoutCorrection(opts)
+}
+
+// nettoyer enlève les octets nuls de fin que les clients C ajoutent à leurs messages
+func nettoyer(message []byte) string {
+	return strings.TrimRight(string(message), "\x00")
+}
+
+// memeAdresse indique si deux adresses UDP désignent la même socket
+func memeAdresse(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return a.String() == b.String()
+	}
+	return ua.IP.Equal(ub.IP) && ua.Port == ub.Port
+}
+
+// connexion regroupe ce que le serveur sait d'un client après son SYN
+type connexion struct {
+	conn     net.PacketConn // socket dédiée au client (nouveau port), chiffrée si besoin
+	addr     *net.UDPAddr   // adresse du client
+	options  options        // extensions négociées
+	racine   *os.Root       // dossier servi
+	depotMax int64          // taille maximale d'un fichier déposé (0 : pas de limite)
+	identite *identite      // identité du client, nil si le serveur n'en demande pas
+	budget   *budget        // ce qu'on peut encore envoyer au client tant qu'il n'est pas validé
+	synAck   []byte         // réponse au SYN, renvoyée si le client répète son SYN
+	lance    bool           // le handshake est terminé et le transfert lancé
+	debut    time.Time      // date du SYN
+	journal  *slog.Logger   // journal de la connexion (client, port de données)
+	trace    *traceur       // trace des envois (-trace), nil sinon
+	horloge  horloge        // horloge du moteur d'envoi, nil : celle du système
+
+	// session (option "session")
+	base      int             // dernier numéro de séquence des transferts précédents
+	fin       []byte          // dernier FIN envoyé, renvoyé s'il s'est perdu
+	requetes  map[int]requete // demandes arrivées en avance, par numéro
+	prochaine int             // numéro de la prochaine demande à servir
+	courante  int             // numéro de la demande en cours
+	fermeture bool            // le client a fermé la session
+}
+
+/*-------------------------------------------------------------- */
+/*--------------------------METADONNEES------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Si l'option "meta" est négociée, le serveur envoie avant le premier segment :
+	META size=<octets> segments=<nb> chunk=<octets> mtime=<unix> [hash=<algo>:<hex>]
+et attend "ACK000000" (le segment 0) avant de commencer l'envoi des données. */
+
+// metadonnees décrit le fichier qui va être transféré
+type metadonnees struct {
+	taille    int64     // taille du fichier en octets
+	segments  int       // nombre de segments de données
+	chunk     int       // taille maximale des données d'un segment
+	mtime     time.Time // date de dernière modification
+	empreinte string    // empreinte du contenu "algo:hex", vide si non calculée
+}
+
+func (m metadonnees) encoder() []byte {
+	message := fmt.Sprintf("META size=%d segments=%d chunk=%d mtime=%d", m.taille, m.segments, m.chunk, m.mtime.Unix())
+	if m.empreinte != "" {
+		message += " hash=" + m.empreinte
+	}
+	return []byte(message)
+}
+
+func decoderMetadonnees(message string) (m metadonnees, err error) {
+	champs := strings.Fields(message)
+	if len(champs) == 0 || champs[0] != "META" {
+		return m, fmt.Errorf("message META invalide : %q", message)
+	}
+	opts := lireOptions(champs[1:])
+	if m.taille, err = strconv.ParseInt(opts["size"], 10, 64); err != nil {
+		return m, fmt.Errorf("META : taille invalide : %v", err)
+	}
+	if m.segments, err = strconv.Atoi(opts["segments"]); err != nil {
+		return m, fmt.Errorf("META : nombre de segments invalide : %v", err)
+	}
+	if m.chunk, err = strconv.Atoi(opts["chunk"]); err != nil {
+		return m, fmt.Errorf("META : taille de chunk invalide : %v", err)
+	}
+	mtime, err := strconv.ParseInt(opts["mtime"], 10, 64)
+	if err != nil {
+		return m, fmt.Errorf("META : mtime invalide : %v", err)
+	}
+	m.mtime = time.Unix(mtime, 0)
+	m.empreinte = opts["hash"]
+	return m, nil
+}
+
+// envoyerMetadonnees envoie le message META et attend son acquittement (ACK000000)
+func envoyerMetadonnees(c *connexion, m metadonnees) error {
+	buf := make([]byte, 1024)
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for essai := 0; essai < essaisControle; essai++ {
+		if _, err := c.conn.WriteTo(c.marquer(m.encoder()), c.addr); err != nil {
+			return err
+		}
+		c.conn.SetReadDeadline(c.temps().maintenant().Add(delaiControle))
+		for {
+			n, from, err := c.conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break //pas d'acquittement : on renvoie META
+				}
+				return err
+			}
+			//le destinataire peut refuser ce qu'on lui annonce (dépôt trop gros)
+			if raison, ok := strings.CutPrefix(nettoyer(buf[:n]), "DENY "); ok && memeAdresse(from, c.addr) {
+				return fmt.Errorf("%w : %s", errRefus, raison)
+			}
+			//l'ACK peut être suivi de la fenêtre du client ("ACK000000 rwnd=<n>")
+			if champs := strings.Fields(nettoyer(buf[:n])); memeAdresse(from, c.addr) && len(champs) > 0 && champs[0] == "ACK000000" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("META non acquitté par %v", c.addr)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*----------------------COTE CLIENT (GO)------------------------ */
+/*-------------------------------------------------------------- */
+
+// au-delà de ce nombre de délais sans nouvelles du serveur, le transfert est abandonné
+const essaisInactivite = 20
+
+// errRefus est renvoyée quand le serveur refuse une demande (DENY)
+var errRefus = errors.New("refusé par le serveur")
+
+// telechargement décrit une demande de fichier faite par le client Go
+type telechargement struct {
+	serveur     string             // ip:port du serveur
+	fichier     string             // nom du fichier demandé
+	sortie      string             // fichier où écrire ce qui est reçu
+	options     options            // options demandées dans le SYN
+	psk         []byte             // clé partagée : si elle est donnée, la connexion doit être chiffrée
+	identite    string             // identité annoncée au serveur, "" si aucune
+	secret      *secretClient      // de quoi prouver cette identité
+	progression bool               // afficher l'avancement (nécessite "meta")
+	stats       string             // format du bilan d'un dépôt ("ligne", "json" ou "aucun")
+	mss         int                // plus grand datagramme accepté (0 : la MTU de l'interface, -1 : pas annoncé)
+	trace       string             // dossier où écrire la trace d'un dépôt, "" si aucune
+	emulation   *reglagesEmulation // réseau émulé (-emulation), nil sinon
+	max         int64              // taille maximale d'un fichier reçu (-max, 0 : pas de limite)
+}
+
+// ouvrir fait le three-way handshake et renvoie l'adresse de la socket de données
+// ainsi que les options acceptées par le serveur. Si le serveur envoie un défi,
+// prouver calcule la preuve d'identité à mettre dans l'ACK. Les délais sont
+// comptés sur l'horloge h.
+func ouvrir(conn net.PacketConn, serveur *net.UDPAddr, demande options, prouver func(defi string) string, h horloge) (*net.UDPAddr, options, error) {
+	syn := "SYN"
+	if len(demande) > 0 {
+		//le SYN est rembourré pour que le serveur puisse y répondre sans dépasser son budget
+		syn = rembourrer(syn + " " + demande.String())
+	}
+	buf := make([]byte, 1500)
+	defer conn.SetReadDeadline(time.Time{})
+
+	for essai := 0; essai < essaisControle; essai++ {
+		if _, err := conn.WriteTo([]byte(syn), serveur); err != nil {
+			return nil, nil, err
+		}
+		conn.SetReadDeadline(h.maintenant().Add(delaiControle))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue //pas de SYN-ACK : on renvoie le SYN
+			}
+			return nil, nil, err
+		}
+
+		//"SYN-ACK<port> [options]", ou "DENY <raison>" si le serveur nous refuse
+		champs := strings.Fields(nettoyer(buf[:n]))
+		if len(champs) > 0 && champs[0] == "DENY" {
+			return nil, nil, fmt.Errorf("refusé par le serveur : %s", strings.Join(champs[1:], " "))
+		}
+		if len(champs) > 0 && champs[0] == "BUSY" {
+			return nil, nil, fmt.Errorf("serveur occupé : %s", strings.Join(champs[1:], " "))
+		}
+		if len(champs) == 0 || !strings.HasPrefix(champs[0], "SYN-ACK") {
+			return nil, nil, fmt.Errorf("SYN-ACK attendu, reçu %q", nettoyer(buf[:n]))
+		}
+		port, err := strconv.Atoi(strings.TrimPrefix(champs[0], "SYN-ACK"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("port invalide dans %q", champs[0])
+		}
+		opts := lireOptions(champs[1:])
+		ack := "ACK"
+		if jeton, ok := opts["jeton"]; ok {
+			ack += " jeton=" + jeton //preuve que l'on a bien reçu le SYN-ACK
+		}
+		if defi, ok := opts["defi"]; ok {
+			if prouver == nil {
+				return nil, nil, fmt.Errorf("le serveur demande une identité (-id et -secret)")
+			}
+			ack += " preuve=" + prouver(defi)
+		}
+		if _, err := conn.WriteTo([]byte(ack), serveur); err != nil {
+			return nil, nil, err
+		}
+		return &net.UDPAddr{IP: serveur.IP, Port: port, Zone: serveur.Zone}, opts, nil
+	}
+	return nil, nil, fmt.Errorf("pas de réponse de %v", serveur)
+}
+
+// telecharger récupère t.fichier auprès du serveur et l'écrit dans t.sortie
+func telecharger(t telechargement) error {
+	conn, dataConn, donnees, opts, err := connecter(t)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//le nom du fichier est terminé par un octet nul, comme pour client1
+	demande := append([]byte(t.fichier), 0)
+	if _, err := dataConn.WriteTo(demande, donnees); err != nil {
+		return err
+	}
+	c := &connexion{conn: dataConn, addr: donnees, options: opts}
+	return recevoirFichier(c, t.sortie, demande, reglagesReception{progression: t.progression, max: t.max})
+}
+
+// recevoirFichier reçoit un fichier dans le fichier local nom, en réservant sa place
+func recevoirFichier(c *connexion, nom string, demande []byte, r reglagesReception) error {
+	sortie, err := os.Create(nom)
+	if err != nil {
+		return err
+	}
+	defer sortie.Close()
+	r.reserver = true
+	return recevoir(c, sortie, demande, r)
+}
+
+// connecter fait le handshake avec le serveur et renvoie la socket du client (à fermer),
+// la même chiffrée si besoin, l'adresse du port de données et les options acceptées
+func connecter(t telechargement) (*net.UDPConn, net.PacketConn, *net.UDPAddr, options, error) {
+	serveur, err := net.ResolveUDPAddr("udp", t.serveur)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	conn, err := net.ListenUDP(reseauClient(serveur), nil)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	//en cas d'erreur, la socket est fermée ici
+	echec := func(err error) (*net.UDPConn, net.PacketConn, *net.UDPAddr, options, error) {
+		conn.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	demandees := maps.Clone(t.options)
+	if len(t.options) > 0 && t.mss >= 0 {
+		//sans option (comme client1) on garde les datagrammes de 1500 octets
+		if t.mss == 0 {
+			t.mss = mtuVers(serveur)
+		}
+		demandees["mss"] = strconv.Itoa(t.mss)
+	}
+	if _, ok := demandees["rwnd"]; ok {
+		demandees["rwnd"] = strconv.Itoa(tamponReception) //tout le tampon est libre au départ
+	}
+	if t.psk != nil {
+		demandees["aead"] = algoChiffrement
+		demandees["nc"] = nouveauNonce()
+	}
+	var prouver func(string) string
+	if t.identite != "" {
+		demandees["id"] = t.identite
+		prouver = func(defi string) string {
+			return t.secret.prouver(t.identite, defi)
+		}
+	}
+
+	//avec -emulation, tout passe par le réseau émulé, handshake compris
+	emulee := emuler(conn, t.emulation)
+	donnees, opts, err := ouvrir(emulee, serveur, demandees, prouver, horlogeSysteme{})
+	if err != nil {
+		return echec(err)
+	}
+
+	//Avec une clé partagée, on ne continue jamais en clair
+	dataConn := emulee
+	if t.psk != nil {
+		if opts["aead"] != algoChiffrement {
+			return echec(fmt.Errorf("%v ne chiffre pas la connexion", serveur))
+		}
+		cles, err := deriverCles(t.psk, demandees["nc"], opts["ns"], false)
+		if err != nil {
+			return echec(err)
+		}
+		dataConn = chiffrer(emulee, cles)
+	}
+	return conn, dataConn, donnees, opts, nil
+}
+
+// au-delà de cette taille annoncée par META, le client ne réserve pas la place du
+// fichier d'avance : un META démesuré ne lui fait pas créer un fichier géant
+const reservationMax = 1 << 30
+
+// reglagesReception règlent recevoir selon qui reçoit
+type reglagesReception struct {
+	progression bool  // afficher l'avancement (nécessite "meta")
+	reserver    bool  // réserver dès le META la place annoncée, jusqu'à reservationMax (téléchargement du client)
+	max         int64 // taille maximale du fichier reçu (0 : pas de limite)
+}
+
+// recevoir réassemble les segments envoyés par pair, les écrit dans sortie et
+// acquitte le plus grand numéro de séquence reçu dans l'ordre.
+// Tant que rien n'est arrivé, la demande est renvoyée à chaque délai.
+// L'écriture sur le disque se fait dans une autre goroutine : ce qui attend
+// d'y être écrit réduit la fenêtre annoncée au serveur ("rwnd"). Comme le moteur
+// d'envoi, recevoir n'attend qu'à travers l'horloge de la connexion.
+func recevoir(c *connexion, sortie *os.File, demande []byte, r reglagesReception) error {
+	conn, pair, opts := c.conn, c.addr, c.options
+	buf := make([]byte, 65536)
+	attendu := 1                      //prochain numéro de séquence à écrire
+	horsOrdre := make(map[int][]byte) //segments arrivés avant leur tour
+	var meta *metadonnees             //annonce du serveur, si "meta" a été négocié
+	recu := false                     //a-t-on reçu quelque chose de l'émetteur ?
+	inactivite := 0
+	pourcentage := -1
+	ecrits := int64(0)
+	empreinte := nouvelleEmpreinte(opts) //nil si "sha256" n'est pas négocié
+	entete := tailleEntete(opts)
+	defer conn.SetReadDeadline(time.Time{})
+
+	ecrire := func(numero int, donnees []byte) error {
+		//avec la compression, chaque segment se décompresse seul
+		if algo := opts["compression"]; algo != "" {
+			brut, err := decompresser(algo, donnees)
+			if err != nil {
+				return fmt.Errorf("segment #%d : %v", numero, err)
+			}
+			donnees = brut
+		}
+		if r.max > 0 && ecrits+int64(len(donnees)) > r.max {
+			return fmt.Errorf("fichier plus gros que %d octets", r.max)
+		}
+		if _, err := sortie.Write(donnees); err != nil {
+			return err
+		}
+		if empreinte != nil {
+			empreinte.Write(donnees)
+		}
+		ecrits += int64(len(donnees))
+
+		//la taille des segments peut changer en cours de route : on compte en octets
+		if r.progression && meta != nil && meta.taille > 0 {
+			if p := int(100 * ecrits / meta.taille); p != pourcentage {
+				pourcentage = p
+				fmt.Printf("\r [%3d%%] #%d", p, numero)
+			}
+		}
+		return nil
+	}
+
+	//les segments arrivés dans l'ordre attendent dans ecritures d'être écrits par une
+	//goroutine de l'horloge de la connexion, réveillée par nouvelles
+	h := c.temps()
+	var mu sync.Mutex
+	var ecritures [][]byte
+	toutRecu := false //plus rien ne sera ajouté à ecritures
+	nouvelles := h.nouveauReveil()
+	ecrivainFini := h.nouveauReveil()
+	var erreurEcriture atomic.Pointer[error]
+	h.lancer(func() {
+		defer ecrivainFini.donner()
+		numero := 0
+		for {
+			mu.Lock()
+			for len(ecritures) == 0 && !toutRecu {
+				mu.Unlock()
+				nouvelles.attendre(-1)
+				mu.Lock()
+			}
+			if len(ecritures) == 0 {
+				mu.Unlock()
+				return
+			}
+			donnees := ecritures[0]
+			ecritures = ecritures[1:]
+			mu.Unlock()
+			numero++
+			if erreurEcriture.Load() != nil {
+				continue //on vide le reste sans l'écrire
+			}
+			if err := ecrire(numero, donnees); err != nil {
+				erreurEcriture.Store(&err)
+			}
+		}
+	})
+	//ajouter confie un segment à l'écriture
+	ajouter := func(donnees []byte) {
+		mu.Lock()
+		ecritures = append(ecritures, donnees)
+		mu.Unlock()
+		nouvelles.donner()
+	}
+	//terminer attend que tout soit écrit
+	terminer := sync.OnceValue(func() error {
+		mu.Lock()
+		toutRecu = true
+		mu.Unlock()
+		nouvelles.donner()
+		ecrivainFini.attendre(-1)
+		if err := erreurEcriture.Load(); err != nil {
+			return *err
+		}
+		return nil
+	})
+	defer terminer()
+
+	//fenetre renvoie combien de segments après le dernier acquitté on peut encore accepter
+	fenetre := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return tamponReception - len(ecritures)
+	}
+
+	//avec "fec", les segments perdus peuvent être reconstruits à partir des parités
+	correction := nouveauCorrecteur(opts)
+
+	acquitter := func(seq int) error {
+		ack := fmt.Sprintf("ACK%06d", seq)
+		if opts.a("rwnd") {
+			ack += fmt.Sprintf(" rwnd=%d", fenetre())
+		}
+		if correction != nil {
+			ack += correction.champ()
+		}
+		_, err := conn.WriteTo([]byte(ack), pair)
+		return err
+	}
+
+	//placer range un segment reçu (ou reconstruit) et acquitte le plus grand numéro reçu dans l'ordre
+	placer := func(message []byte) error {
+		if len(message) < entete {
+			return nil
+		}
+		seq, err := strconv.Atoi(string(message[:6]))
+		if opts.a("crc32c") && !verifierSegment(message) {
+			//segment abîmé : on le jette et on le redemande (si son numéro est lisible)
+			segmentsCorrompus.Add(1)
+			if err == nil {
+				if _, err := conn.WriteTo([]byte(fmt.Sprintf("NACK%06d", seq)), pair); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return nil
+		}
+		c.log().Log(context.Background(), niveauPaquets, "segment reçu", "seq", seq, "taille", len(message))
+		//en session, les numéros continuent ceux des transferts précédents
+		seq -= c.base
+		if seq >= 1 {
+			recu = true
+		}
+		//au-delà de la fenêtre annoncée, on n'a pas la place de garder le segment
+		if seq == attendu && fenetre() > 0 {
+			ajouter(append([]byte(nil), message[entete:]...))
+			attendu++
+			//les segments arrivés en avance peuvent maintenant être écrits
+			for segment, ok := horsOrdre[attendu]; ok; segment, ok = horsOrdre[attendu] {
+				ajouter(segment)
+				delete(horsOrdre, attendu)
+				attendu++
+			}
+		} else if seq > attendu && seq < attendu+fenetre() {
+			horsOrdre[seq] = append([]byte(nil), message[entete:]...)
+		}
+		return acquitter(c.base + attendu - 1)
+	}
+
+	for {
+		if err := erreurEcriture.Load(); err != nil {
+			return *err
+		}
+
+		conn.SetReadDeadline(h.maintenant().Add(delaiControle))
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				return err
+			}
+			inactivite++
+			if inactivite > essaisInactivite {
+				return fmt.Errorf("plus de nouvelles de %v", pair)
+			}
+			if !recu {
+				_, err = conn.WriteTo(demande, pair)
+			} else {
+				err = acquitter(c.base + attendu - 1) //on rappelle où on en est
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		//on ignore ce qui ne vient pas de la socket de données du serveur
+		if !memeAdresse(addr, pair) {
+			continue
+		}
+		inactivite = 0
+		message := buf[:n]
+
+		switch {
+		case strings.HasPrefix(string(message), "FIN"):
+			if !c.duTransfert(nettoyer(message)) {
+				continue //FIN répété d'un transfert précédent de la session
+			}
+			c.base += attendu - 1
+			if err := terminer(); err != nil {
+				return err
+			}
+			if r.progression && meta != nil {
+				fmt.Println()
+			}
+			if meta != nil && ecrits != meta.taille {
+				return fmt.Errorf("%w : %d octets reçus, %d annoncés", errIntegrite, ecrits, meta.taille)
+			}
+			if empreinte != nil {
+				annoncee := lireFin(nettoyer(message))
+				if annoncee == "" && meta != nil {
+					annoncee = meta.empreinte
+				}
+				if calculee := formaterEmpreinte(empreinte); calculee != annoncee {
+					return fmt.Errorf("%w : empreinte %s, %s annoncée", errIntegrite, calculee, annoncee)
+				}
+			}
+			return nil
+
+		case strings.HasPrefix(string(message), "DENY"):
+			return fmt.Errorf("%w : %s", errRefus, strings.TrimPrefix(nettoyer(message), "DENY "))
+
+		case strings.HasPrefix(string(message), "PMTU"):
+			//sonde de taille : on dit au serveur combien d'octets sont arrivés
+			if _, err := conn.WriteTo([]byte(fmt.Sprintf("ACKPMTU%06d", n)), pair); err != nil {
+				return err
+			}
+
+		case strings.HasPrefix(string(message), "META"):
+			if !c.duTransfert(nettoyer(message)) {
+				continue
+			}
+			recu = true
+			m, err := decoderMetadonnees(nettoyer(message))
+			if err != nil {
+				return err
+			}
+			if r.max > 0 && m.taille > r.max {
+				return fmt.Errorf("fichier plus gros que %d octets", r.max)
+			}
+			if meta == nil {
+				meta = &m
+				//le client réserve la place du fichier dès maintenant ; la taille vient du
+				//serveur : au-delà de reservationMax, le fichier grandit au fil des écritures
+				if r.reserver && m.taille <= reservationMax {
+					if err := sortie.Truncate(m.taille); err != nil {
+						return err
+					}
+				}
+			}
+			if err := acquitter(0); err != nil {
+				return err
+			}
+
+		case correction != nil && strings.HasPrefix(string(message), "FEC"):
+			//parité : elle peut suffire à reconstruire des segments perdus
+			for _, segment := range correction.parite(message) {
+				if err := placer(segment); err != nil {
+					return err
+				}
+			}
+
+		default:
+			//en session, le client peut envoyer ses prochaines demandes pendant un dépôt
+			if opts.a("session") && c.noterRequete(string(message)) {
+				continue
+			}
+			if err := placer(message); err != nil {
+				return err
+			}
+			if correction == nil || n < entete || (opts.a("crc32c") && !verifierSegment(message)) {
+				continue
+			}
+			if seq, err := strconv.Atoi(string(message[:6])); err == nil {
+				//avec ce segment, un bloc dont on a les parités peut être complet
+				for _, segment := range correction.donnee(seq, message) {
+					if err := placer(segment); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*--------------------------IPv4 ET IPv6------------------------ */
+/*-------------------------------------------------------------- */
+
+/* Par défaut le serveur écoute sur toutes les interfaces, en IPv4 et en IPv6
+("udp"). -reseau udp4 ou udp6 le limite à une famille, -ecoute l'attache à une
+adresse ou à une interface. Les sockets de données sont ouvertes sur la même
+adresse et la même famille que la socket d'écoute. Le SYN-ACK n'annonce que le
+port de données : le client le joint à l'adresse qu'il a utilisée pour le SYN,
+ce qui marche aussi en IPv6, y compris pour une adresse de lien local
+("fe80::1%eth0"). */
+
+// adresseEcoute renvoie l'adresse d'écoute du serveur : ecoute est vide (toutes les
+// interfaces), une adresse IP ou le nom d'une interface
+func adresseEcoute(reseau, ecoute, port string) (*net.UDPAddr, error) {
+	switch reseau {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("réseau %q inconnu (udp, udp4 ou udp6)", reseau)
+	}
+	if ecoute == "" {
+		return net.ResolveUDPAddr(reseau, ":"+port)
+	}
+	if interfaceReseau, err := net.InterfaceByName(ecoute); err == nil {
+		ip, err := adresseInterface(interfaceReseau, reseau)
+		if err != nil {
+			return nil, err
+		}
+		ecoute = ip.String()
+		if ip.IsLinkLocalUnicast() && ip.To4() == nil {
+			ecoute += "%" + interfaceReseau.Name
+		}
+	}
+	return net.ResolveUDPAddr(reseau, net.JoinHostPort(ecoute, port))
+}
+
+// adresseInterface choisit une adresse de l'interface dans la famille demandée,
+// en préférant IPv4 puis les adresses globales quand les deux familles conviennent
+func adresseInterface(interfaceReseau *net.Interface, reseau string) (net.IP, error) {
+	adresses, err := interfaceReseau.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var choix net.IP
+	meilleur := -1
+	for _, a := range adresses {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		v4 := ip.To4() != nil
+		if (reseau == "udp4" && !v4) || (reseau == "udp6" && v4) {
+			continue
+		}
+		score := 0
+		if v4 {
+			score += 2
+		}
+		if !ip.IsLinkLocalUnicast() {
+			score++
+		}
+		if score > meilleur {
+			choix, meilleur = ip, score
+		}
+	}
+	if choix == nil {
+		return nil, fmt.Errorf("pas d'adresse %s sur l'interface %s", reseau, interfaceReseau.Name)
+	}
+	return choix, nil
+}
+
+// reseauClient renvoie le réseau à utiliser pour joindre le serveur, de la famille de son adresse
+func reseauClient(serveur *net.UDPAddr) string {
+	if serveur.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// mtuVers renvoie le plus grand datagramme UDP que l'interface qui mène à addr
+// envoie sans le fragmenter, mssMax si on ne peut pas le savoir
+func mtuVers(addr *net.UDPAddr) int {
+	//une socket "connectée" n'envoie rien : le noyau choisit seulement la route et l'adresse locale
+	conn, err := net.DialUDP(reseauClient(addr), nil, addr)
+	if err != nil {
+		return mssMax
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	entetes := 20 + 8 //IPv4 + UDP
+	if local.IP.To4() == nil {
+		entetes = 40 + 8 //IPv6 + UDP
+	}
+	if mtu := mtuInterface(local.IP); mtu > 0 {
+		return min(mtu-entetes, mssMax)
+	}
+	return mssMax
+}
+
+// au-delà de cette durée, les MTU des interfaces sont relues
+const dureeMtuInterfaces = 30 * time.Second
+
+// mtuInterfaces garde la MTU de l'interface de chaque adresse locale : le serveur
+// n'a pas à relire toutes les interfaces à chaque SYN
+var mtuInterfaces struct {
+	sync.Mutex
+	lues time.Time
+	mtu  map[string]int // adresse IP locale -> MTU de son interface
+}
+
+// mtuInterface renvoie la MTU de l'interface qui porte l'adresse locale ip, 0 si on ne la trouve pas
+func mtuInterface(ip net.IP) int {
+	mtuInterfaces.Lock()
+	defer mtuInterfaces.Unlock()
+	if mtuInterfaces.mtu == nil || time.Since(mtuInterfaces.lues) > dureeMtuInterfaces {
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return 0
+		}
+		mtuInterfaces.mtu = make(map[string]int)
+		for _, i := range interfaces {
+			adresses, _ := i.Addrs()
+			for _, a := range adresses {
+				if ipnet, ok := a.(*net.IPNet); ok {
+					mtuInterfaces.mtu[ipnet.IP.String()] = i.MTU
+				}
+			}
+		}
+		mtuInterfaces.lues = time.Now()
+	}
+	return mtuInterfaces.mtu[ip.String()]
+}
+
+// socketEcoute est la socket d'écoute du serveur, lue et écrite à travers conn :
+// la même socket, capturée (-capture) et émulée (-emulation) si besoin
+type socketEcoute struct {
+	*net.UDPConn
+	conn net.PacketConn
+}
+
+// fermerAuSignal ferme la socket d'écoute quand le serveur est arrêté (^C, SIGTERM) :
+// accueillir rend la main et main se termine par ses defer (capture, traces...)
+func (s *socketEcoute) fermerAuSignal() {
+	signaux := make(chan os.Signal, 1)
+	signal.Notify(signaux, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signaux
+		signal.Stop(signaux) //un second ^C arrête le serveur tout de suite
+		s.Close()
+	}()
+}
+
+func (s *socketEcoute) WriteToUDP(p []byte, addr *net.UDPAddr) (int, error) {
+	return s.conn.WriteTo(p, addr)
+}
+
+func (s *socketEcoute) ReadFromUDP(p []byte) (int, *net.UDPAddr, error) {
+	n, addr, err := s.conn.ReadFrom(p)
+	if err != nil {
+		return n, nil, err
+	}
+	client, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return n, nil, fmt.Errorf("adresse inattendue : %v", addr)
+	}
+	return n, client, nil
+}
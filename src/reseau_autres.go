@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// interdireFragmentation est sans effet ailleurs que sous Linux : une sonde trop
+// grande peut y être fragmentée, la recherche de PMTU la croit alors passée
+func interdireFragmentation(conn *net.UDPConn) {}
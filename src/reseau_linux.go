@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// interdireFragmentation demande au noyau de ne jamais fragmenter les datagrammes de la
+// socket, même quand il a appris une MTU plus petite par ICMP : une sonde trop grande
+// est alors perdue (ou refusée à l'envoi) au lieu de passer en morceaux
+func interdireFragmentation(conn *net.UDPConn) {
+	brut, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	brut.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	})
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,226 +18,384 @@ import (
 /*--------------------------FONCTIONS--------------------------- */
 /*-------------------------------------------------------------- */
 
-func progression(next_biggest_ack *int, seq_max int) {
-	//affiche le pourcentage d'avancement toutes les 100ms
-	seq_max_float := float64(seq_max)
-	for *next_biggest_ack-1 < seq_max {
-		time.Sleep(time.Millisecond * 100)
-		fmt.Printf("\r [%2.0f%%] #%d\n", 100*float64(*next_biggest_ack-1)/seq_max_float, *next_biggest_ack-1)
+// réglages de l'envoi pour ce scénario
+var reglages = reglagesEmission{winSize: 75, timeout: time.Millisecond * 150}
+
+// scénario servi, pour les métriques
+const scenario = "3"
+
+// format du bilan affiché à la fin de chaque envoi ("ligne", "json" ou "aucun")
+var formatStats = "ligne"
+
+func sendFile(c *connexion, fileName string) {
+
+	//On ouvre notre fichier (sans pouvoir sortir du dossier servi)
+	var file, err = c.racine.Open(fileName)
+	if err != nil {
+		c.log().Warn("fichier introuvable", "fichier", fileName, "err", err)
+		compterTransfert(nil, scenario, err)
+		refuser(c, err)
+		return
+	}
+
+	defer file.Close()
+
+	stats := nouvellesStatistiques(fileName, c.addr, c.temps())
+	_, err = envoyer(c, file, fileName, reglages, stats)
+	compterTransfert(stats, scenario, err)
+	if err != nil {
+		c.log().Error("envoi interrompu", "fichier", fileName, "err", err)
+		refuser(c, err)
+		return
+	}
+	stats.afficher(formatStats)
+}
+
+// sendListe répond à LIST ou STAT par un document JSON, envoyé comme un fichier
+func sendListe(c *connexion, r requete) {
+	doc, err := decrire(c, r.commande, r.nom)
+	if err != nil {
+		c.log().Warn(r.commande+" impossible", "nom", r.nom, "err", err)
+		compterTransfert(nil, scenario, err)
+		refuser(c, err)
+		return
+	}
+	stats := nouvellesStatistiques(r.commande, c.addr, c.temps())
+	_, err = envoyer(c, doc, r.commande+" "+r.nom, reglages, stats)
+	compterTransfert(stats, scenario, err)
+	if err != nil {
+		c.log().Error("envoi interrompu", "fichier", r.commande+" "+r.nom, "err", err)
+		refuser(c, err)
+		return
+	}
+	stats.afficher(formatStats)
+}
+
+// refuser prévient le client que sa demande a échoué, s'il sait lire DENY
+// (c'est le cas de tout client qui a négocié des options)
+func refuser(c *connexion, err error) {
+	if len(c.options) > 0 {
+		_, _ = c.conn.WriteTo([]byte("DENY "+err.Error()), c.addr)
 	}
 }
 
-func getSeq(ack string) (seq int) {
-	fmt.Sscanf(ack, "%06d", &seq)
-	return seq
+// La goroutine file récupère le nom du fichier à envoyer et lance sa transmission en appelant sendFile
+// (avec l'option "flux", elle le fait pour chaque flux ouvert par le client)
+func file(c *connexion) {
+	if c.options.a("flux") {
+		servirFlux(c, traiter)
+		return
+	}
+	traiter(c)
 }
 
-func sendFile(conn *net.UDPConn, fileName string, addr *net.UDPAddr) {
+// traiter sert les demandes reçues sur une connexion ou sur un flux
+func traiter(c *connexion) {
+
+	buffer := make([]byte, 1024)
+	/*---------------RECUPERER LE NOM DU FICHIER---------------- */
+	n, from, err := c.conn.ReadFrom(buffer)
+	for err == nil && !memeAdresse(from, c.addr) {
+		n, from, err = c.conn.ReadFrom(buffer) //on n'écoute que le client
+	}
 
-	//On ouvre notre fichier
-	var file, err = os.Open(fileName)
 	if err != nil {
-		fmt.Println(err)
+		c.log().Warn("pas de demande", "err", err)
 		return
 	}
 
-	defer file.Close()
+	//La demande est arrivée sur le port annoncé dans le SYN-ACK : le client est joignable
+	c.budget.valider()
 
-	//Si le fichier n'est pas vide
-	if file != nil {
-		//On cherche la taille du fichier
-		fi, err := file.Stat()
-		if err != nil {
-			fmt.Println(err)
-			return
+	//la demande se termine par un octet nul (un datagramme vide n'en a pas)
+	buffer = buffer[:max(n-1, 0)]
+
+	fileName := string(buffer)
+	c.log().Debug("demande reçue", "message", fileName)
+
+	r, ok := c.lireRequete(fileName)
+	for {
+		if ok {
+			servir(c, r)
+		}
+		//en session, on attend la demande suivante
+		if !c.options.a("session") {
+			break
+		}
+		if r, ok = c.attendreRequete(); !ok {
+			break
 		}
-		//fmt.Println("The file is", fi.Size(), "bytes long")
+	}
 
-		//chunk de données à envoyer
-		chunkSize := 1494
+	//hors session, on laisse au client le temps de redemander le FIN s'il s'est perdu
+	if !c.options.a("session") {
+		c.attendreFermeture()
+	}
+	c.conn.Close() //une fois que le(s) fichier(s) envoyé(s), on ferme la connexion
+	c.log().Info("connexion terminée", "duree", c.temps().maintenant().Sub(c.debut).Round(time.Millisecond))
+}
 
-		nbseg := int(fi.Size()) / chunkSize
-		if nbseg*chunkSize < int(fi.Size()) {
-			nbseg = nbseg + 1
+// servir traite une demande du client : envoi ou dépôt d'un fichier, liste d'un dossier
+func servir(c *connexion, r requete) {
+	//Un client authentifié ne peut demander (ou déposer) que ce que son identité autorise
+	option := commandes[r.commande]
+	c.log().Debug("demande", "commande", r.commande, "nom", r.nom)
+	switch {
+	case c.identite != nil && !c.identite.autorise(r.nom):
+		_, _ = c.conn.WriteTo([]byte("DENY accès refusé à "+r.nom), c.addr)
+	case option != "" && !c.options.a(option):
+		_, _ = c.conn.WriteTo([]byte("DENY commande "+r.commande+" non acceptée"), c.addr)
+	case r.commande == "LIST" || r.commande == "STAT":
+		/*---------------------DECRIRE LE DOSSIER------------------- */
+		sendListe(c, r)
+	case r.commande == "PUT":
+		/*--------------------RECEVOIR LE FICHIER------------------- */
+		err := recevoirDepot(c, r.nom)
+		compterTransfert(nil, scenario, err)
+		if err != nil {
+			c.log().Error("dépôt refusé", "fichier", r.nom, "err", err)
 		}
-		//fmt.Println(nbseg, "packet(s) to send")
+		confirmerDepot(c, err)
+	default:
+		/*--------------------ENVOYER LE FICHIER-------------------- */
+		sendFile(c, r.nom)
+	}
+}
+
+// serveur regroupe ce que main a lu sur la ligne de commande et ce qu'il a ouvert
+type serveur struct {
+	reseau     string                  // udp, udp4 ou udp6
+	adresse    *net.UDPAddr            // adresse d'écoute, les ports de données sont ouverts sur la même IP
+	psk        []byte                  // clé partagée, nil : connexions en clair
+	identites  map[string]*identite    // identités autorisées, nil : pas d'authentification
+	filtre     *atomic.Pointer[regles] // règles de filtrage et limites du moment
+	racine     *os.Root                // dossier servi
+	depot      bool                    // option "put" acceptée
+	depotMax   int64                   // taille maximale d'un fichier déposé (0 : pas de limite)
+	mss        int                     // plus grands datagrammes acceptés (0 : la MTU de l'interface)
+	emulation  *reglagesEmulation      // réseau émulé, nil sinon
+	pcap       *capture                // capture des datagrammes, nil sinon
+	trace      string                  // dossier des traces, "" si aucune
+	connexions *registre               // connexions ouvertes : clé = ip:port_init ; valeur = connexion
+	horloge    horloge                 // horloge des connexions et de l'anti-rejeu, nil : celle du système
+	enCours    sync.WaitGroup          // goroutines des connexions lancées
+}
 
-		//création d'un buffer
-		packets := make([][]byte, nbseg)
+// temps renvoie l'horloge du serveur (celle du système si aucune n'est donnée)
+func (srv *serveur) temps() horloge {
+	if srv.horloge == nil {
+		return horlogeSysteme{}
+	}
+	return srv.horloge
+}
 
-		//On créé nos différents paquets dans une map
-		for i := 0; i < len(packets); i++ {
-			packets[i] = make([]byte, chunkSize+6)
+// accueillir lit la socket d'écoute, fait les handshakes et lance une goroutine par
+// connexion ; elle ne rend la main qu'en cas d'erreur de lecture (socket fermée)
+func (srv *serveur) accueillir(connection *socketEcoute) error {
+	//On crée et initialise un objet buffer de type []byte et taille 1500
+	buffer := make([]byte, 1500)
 
-			//on ajoute le header en rajoutant les 0 nécessaires
-			copy(packets[i][0:6], fmt.Sprintf("%06d", i+1))
+	//Nonces des handshakes récents, pour reconnaître un SYN rejoué
+	noncesVus := make(map[string]time.Time)
+	current_conn := srv.connexions
 
-			//on ajoute le chunk de données
-			_, _ = file.Read(packets[i][6:])
-		}
+	for {
 
-		//création de nos variables
-		timeouts := make([]time.Time, len(packets)+2) //+2 sinon index out of range
-		buf := make([]byte, 32)
-		next_seq := 1
-		last_ack := 0
-		same_ack := 0
-		lost_ack := false
-		borneInfSlide := false
-		borneInf := 1
-		borneSup := 0
-		next_biggest_ack := last_ack + 1 //<=> dernier plus grand ack recu + 1
-		winSize := 75
-		seq_max := len(packets)
-
-		send := func(num_seq int) {
-			//Si le numéro de séquence courant est inf ou = au numéro de séquence max
-			if num_seq <= seq_max {
-				//Si c'est le dernier paquet : on envoie que la partie remplie du paquet
-				if num_seq == seq_max {
-					n := (int)(fi.Size()) - (int)((seq_max-1)*(chunkSize))
-					//fmt.Println("Sending last packet number", num_seq)
-					//n+6 car il faut rajouter le header
-					_, err = conn.WriteToUDP(packets[num_seq-1][0:n+6], addr)
-				} else {
-					//Sinon on envoie le paquet
-					//fmt.Println("Sending packet number", num_seq)
-					_, err = conn.WriteToUDP(packets[num_seq-1], addr)
-				}
-				//On set le timeout pour ce paquet
-				timeouts[num_seq-1] = time.Now()
-			}
+		//On lit le message recu et on le met dans le buffer
+		n, addr, err := connection.ReadFromUDP(buffer)
+		if err == nil && tracer(addr) {
+			journalClient(addr).Log(context.Background(), niveauPaquets, "reçu", "message", nettoyer(buffer[:n]))
 		}
 
-		window := func() bool {
-			//Si le # du prochain paquet est inférieur au dernier plus grand ack + 1
-			if next_seq < next_biggest_ack {
-				next_seq = next_biggest_ack
-			}
+		if err != nil { //Gestion en cas d'erreur
+			return err
+
+			/* si l'adresse de connexion n'est pas dans la map :
+			- on vérifie que le client nous a envoyé un SYN
+			- si oui on ajoute l'adresse à la map
+			- sinon on s'en fiche de ce client */
+		} else if c := current_conn.trouver(addr.String()); c == nil {
+
+			message := nettoyer(buffer[:n])
+			if strings.Contains(message, "SYN") {
+
+				journalClient(addr).Debug("SYN", "message", message)
+
+				//On garde les options du SYN que l'on sait gérer ("SYN" seul : aucune)
+				demande := make(options)
+				if champs := strings.Fields(message); champs[0] == "SYN" {
+					demande = lireOptions(champs[1:])
+				}
 
-			//on calcule le quotient ENTIER du nba-1 par le winSize
-			quotient := (next_biggest_ack - 1) / winSize
-
-			if lost_ack == true {
-				borneInf = next_biggest_ack
-				lost_ack = false
-				borneInfSlide = true
-			} else {
-				//Si la borne Inf n'a pas ete slidée
-				if borneInfSlide == false {
-					//on calcule la borne inférieure de la fenêtre en multipliant le quotient par le winSize et en ajoutant 1
-					borneInf = (quotient * winSize) + 1
-
-				} else { //la borne a été slidée
-					if borneSup < next_biggest_ack { //le next_biggest_ack devient supérieur à la borne Sup
-						borneInf = borneInf + winSize //on change alors la borne inférieure
+				//Tant que le client n'a pas prouvé qu'il est joignable, on ne lui
+				//envoie pas plus de facteurAmplification fois ce qu'il nous a envoyé
+				b := &budget{recus: n}
+				repondre := func(reponse []byte) {
+					if b.depenser(len(reponse)) {
+						_, _ = connection.WriteToUDP(reponse, addr)
 					}
 				}
-			}
 
-			//on calcule la borne supérieure de la fenêtre en ajoutant winSize-1 à la borne inf
-			borneSup = (borneInf + winSize - 1)
+				//On applique les règles de filtrage et les limites du moment
+				current_conn.purger()
+				limites := srv.filtre.Load()
+				if !limites.autorise(ipClient(addr)) {
+					repondre([]byte("DENY adresse refusée"))
+					compterHandshake("refuse")
+					journalClient(addr).Info("adresse refusée")
+					continue
+				}
+				if raison := current_conn.occupe(ipClient(addr), limites); raison != "" {
+					repondre([]byte("BUSY " + raison))
+					compterHandshake("occupe")
+					journalClient(addr).Info("serveur occupé", "raison", raison)
+					continue
+				}
 
-			//On retourne true si le # de paquet courant est compris dans les bornes de la fenêtre en cours
-			if (next_seq >= borneInf) && (next_seq <= borneSup) {
-				return true
-			} else {
-				return false
-			}
-		}
+				//Un SYN qui reprend le nonce d'un handshake récent est un rejeu : on l'ignore
+				if nc, ok := demande["nc"]; ok {
+					maintenant := srv.temps().maintenant()
+					nettoyerVus(noncesVus, dureeRejeu, maintenant)
+					if _, vu := noncesVus[nc]; vu {
+						continue
+					}
+					noncesVus[nc] = maintenant
+				}
+				opts := accepter(demande)
+				accepterMss(demande, opts, addr, srv.mss)
+				accepterFlux(demande, opts)
+				if !srv.depot {
+					delete(opts, "put")
+				}
 
-		go func() {
-			//tant que le dernier plus grand ack + 1 inf au # du dernier paquet
-			for next_biggest_ack <= seq_max {
+				var cles *clesSession
+				var err error
+				if srv.psk != nil {
+					cles, err = accepterChiffrement(srv.psk, demande, opts)
+					if err != nil {
+						//le client ne sait pas chiffrer : on le lui dit et on l'oublie
+						repondre([]byte("DENY " + err.Error()))
+						compterHandshake("rejete")
+						journalClient(addr).Info("client refusé", "erreur", err)
+						continue
+					}
+				}
 
-				//On attend 1ms
-				time.Sleep(time.Millisecond * 1)
+				//Le client doit annoncer une identité connue, il recevra un défi à signer
+				var id *identite
+				if srv.identites != nil {
+					id, err = demanderAuthentification(srv.identites, demande, opts)
+					if err != nil {
+						repondre([]byte("DENY " + err.Error()))
+						compterHandshake("rejete")
+						journalClient(addr).Info("client refusé", "erreur", err)
+						continue
+					}
+				}
 
-				//Si notre paquet est OK
-				if window() {
-					//On l'envoie
-					send(next_seq)
+				//Un client qui a envoyé des options doit nous renvoyer ce jeton dans son ACK
+				if len(demande) > 0 {
+					opts["jeton"] = nouveauNonce()
+				}
 
-					//On passe au prochain paquet
-					next_seq++
+				/*------OUVERTURE DE LA CONNEXION SUR LE NOUVEAU PORT------ */
+				//le port est tiré au hasard : seul celui qui a reçu le SYN-ACK le connait
+				conn, port, err := ouvrirPortDonnees(srv.reseau, srv.adresse)
+				if err != nil {
+					journalClient(addr).Error("port de données impossible", "err", err)
+					metriquePortsEchecs.ajouter("", 1)
+					continue
+				}
+				//la socket appartient maintenant à la connexion : elle est fermée quand le
+				//registre l'oublie (fin du transfert, handshake abandonné ou refusé)
 
-				} else {
-					//Sinon, si le temps de timeout de l'ACK attendu est supérieur au timeout
-					if time.Since(timeouts[next_biggest_ack]) > time.Millisecond*150 {
-						//Timeout -> On retransmet le paquet perdu
-						next_seq = next_biggest_ack
+				//Pendant la recherche de PMTU, une sonde trop grande doit être perdue, pas fragmentée
+				if opts.a("pmtud") {
+					interdireFragmentation(conn)
+				}
 
-					}
+				//Le budget du client s'applique aussi au nouveau port, et si la connexion
+				//est chiffrée, tout ce qui y passe l'est aussi
+				var dataConn net.PacketConn = borner(capturer(emuler(conn, srv.emulation), srv.pcap), addr, b)
+				if cles != nil {
+					dataConn = chiffrer(dataConn, cles)
 				}
-			}
-		}()
-		//on affiche la progression en pourcentages de notre envoi
-		//go progression(&next_biggest_ack, seq_max)
-
-		//tant que le plus grand ack +1  inf au # du dernier paquet,
-		for next_biggest_ack <= seq_max {
-			//On lit l'ack recu
-			_, _, err := conn.ReadFromUDP(buf)
-			//fmt.Println("ACK recu",string(buf))
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			//on récupère le numéro de séquence
-			ack := getSeq(string(buf[3:9]))
-
-			//Si c'est le meme ack qu'avant -> on incrémente same_ack
-			if ack == last_ack {
-				same_ack++
-				//A partir d'un certain nombre d'ack identiques recus, on renvoie le paquet perdu
-				//Fast retransmit
-				if same_ack > 2 {
-					next_seq = ack + 1
-					lost_ack = true
-					same_ack = 0
+
+				//Le serveur est pret : on envoie le SYN-ACK avec le nouveau port (et les options acceptées)
+				synAck := "SYN-ACK" + strconv.Itoa(port)
+				if len(opts) > 0 {
+					synAck += " " + opts.String()
 				}
-			}
-			//si l'ack est plus grand ou = à celui d'avant, il devient last_ack
-			if ack >= last_ack {
-				last_ack = ack
+				j := journalClient(addr).With("port", port)
+				c := &connexion{conn: dataConn, addr: addr, options: opts, racine: srv.racine, depotMax: srv.depotMax, identite: id, budget: b, synAck: []byte(synAck), journal: j, horloge: srv.horloge}
+				c.debut = c.temps().maintenant()
+				current_conn.ajouter(addr.String(), c)
+				repondre([]byte(synAck))
+				compterHandshake("accepte")
+				j.Info("connexion ouverte", "options", opts.String())
 			}
 
-			//Si l'ack est plus grand que le dernier plus grand ack recu +1, on met à jour ce dernier
-			if last_ack >= next_biggest_ack {
-				next_biggest_ack = last_ack + 1
-			}
+		} else if strings.HasPrefix(nettoyer(buffer[:n]), "SYN") {
 
-			//Fin de l'envoi : on envoie "FIN" au client
-			if last_ack == seq_max {
-				//fmt.Println("End of transfer")
-				_, err = conn.WriteToUDP([]byte("FIN"), addr)
+			//SYN répété (le SYN-ACK s'est perdu) : tant que la connexion n'est pas lancée, on renvoie le même SYN-ACK
+			c.budget.recevoir(n)
+			if !c.lance && c.budget.depenser(len(c.synAck)) {
+				_, _ = connection.WriteToUDP(c.synAck, addr)
 			}
-		}
 
-	}
-}
+		} else if strings.Contains(nettoyer(buffer[:n]), "ACK") { //on prend en compte les ACK que des clients connus (adresse présente dans la map)
 
-// La goroutine file récupère le nom du fichier à envoyer et lance sa transmission en appelant sendFile
-func file(connStruct net.UDPConn, addrStruct net.UDPAddr) {
+			c.budget.recevoir(n)
 
-	buffer := make([]byte, 1024)
-	/*---------------RECUPERER LE NOM DU FICHIER---------------- */
-	n, _, err := (&connStruct).ReadFromUDP(buffer)
+			//ACK répété ou rejoué : la connexion est déjà lancée
+			if c.lance {
+				continue
+			}
 
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
+			//Le client renvoie le jeton du SYN-ACK : il reçoit bien ce qu'on envoie à son adresse
+			if jeton, ok := c.options["jeton"]; ok {
+				if !verifierJeton(nettoyer(buffer[:n]), jeton) {
+					continue
+				}
+				c.budget.valider()
+			}
 
-	buffer = buffer[:n-1]
+			//Si le client doit s'authentifier, son ACK porte la preuve de son identité
+			if c.identite != nil {
+				if err := c.identite.verifierPreuve(nettoyer(buffer[:n]), c.options["defi"]); err != nil {
+					_, _ = c.conn.WriteTo([]byte("DENY "+err.Error()), c.addr)
+					current_conn.retirer(addr.String())
+					c.log().Info("authentification refusée", "erreur", err)
+					continue
+				}
+			}
 
-	fileName := string(buffer)
-	//fmt.Println("Received message", n, "bytes:", fileName)
+			c.log().Debug("handshake terminé")
+			c.lance = true
+			if srv.trace != "" {
+				var err error
+				if c.trace, err = ouvrirTrace(srv.trace, "server", c.conn.LocalAddr(), c.addr, c.temps()); err != nil {
+					c.log().Warn("trace impossible", "err", err)
+				}
+			}
+			srv.enCours.Go(func() {
+				file(c)
+				if err := c.trace.fermer(); err != nil {
+					c.log().Warn("trace incomplète", "err", err)
+				}
+				current_conn.retirer(addr.String()) //le transfert est fini : la place est libérée et la socket fermée
+			})
+		}
 
-	/*--------------------ENVOYER LE FICHIER-------------------- */
-	sendFile(&connStruct, fileName, &addrStruct)
+	}
+
+}
 
-	connStruct.Close() //une fois que le fichier est envoyé, on ferme la connexion
+// arreter interrompt les connexions en cours et attend que leurs goroutines aient
+// fini, traces comprises
+func (srv *serveur) arreter() {
+	srv.connexions.vider()
+	srv.enCours.Wait()
 }
 
 /*-------------------------------------------------------------- */
@@ -244,101 +407,132 @@ func main() {
 	/*-----------------------INITIALISATION--------------------- */
 	/*---------------------------------------------------------- */
 
-	//On récupère le port
-	arguments := os.Args
-	if len(arguments) < 2 {
-		fmt.Println("Usage : ./serveur <port>")
+	//On récupère le port et les options du serveur
+	fichierPSK := flag.String("psk", "", "fichier contenant la clé partagée : toutes les connexions sont alors chiffrées")
+	fichierIdentites := flag.String("identites", "", "fichier des identités autorisées : les clients doivent alors s'authentifier")
+	dossier := flag.String("racine", ".", "dossier servi, les clients ne peuvent rien demander en dehors")
+	fichierFiltre := flag.String("filtre", "", "fichier des adresses autorisées/refusées et des limites de connexions (relu sur SIGHUP)")
+	ecoute := flag.String("ecoute", "", "adresse IP ou interface d'écoute (par défaut toutes)")
+	reseau := flag.String("reseau", "udp", "udp (IPv4 et IPv6), udp4 ou udp6")
+	depot := flag.Bool("depot", false, "accepter les fichiers envoyés par les clients (option \"put\")")
+	depotMax := flag.Int64("depotMax", 1<<30, "taille maximale (octets) d'un fichier déposé, 0 : pas de limite")
+	flag.StringVar(&formatStats, "stats", formatStats, "bilan affiché à la fin de chaque envoi : ligne, json ou aucun")
+	adresseMetriques := flag.String("metriques", "", "adresse (ex. :9100) où servir les métriques Prometheus sur /metrics")
+	reglagesReseau := flag.String("emulation", "", "conditions du réseau émulé : \"perte=2% rafales=1%/30% delai=20ms gigue=5ms debit=10M desordre=1% double=1%\"")
+	fichierCapture := flag.String("capture", "", "fichier pcapng où enregistrer les datagrammes envoyés et reçus par le serveur")
+	dossierTrace := flag.String("trace", "", "dossier où écrire la trace (JSON par ligne, façon qlog) de chaque connexion")
+	niveau := flag.String("journal", "info", "niveau du journal : paquets, debug, info, warn ou error")
+	suivis := flag.String("suivre", "", "adresses IP (séparées par des virgules) des clients dont on trace les paquets quel que soit le niveau")
+	mss := flag.Int("mss", 0, "taille maximale des datagrammes acceptée pour les clients qui la négocient (0 : la MTU de l'interface)")
+	flag.Usage = func() {
+		fmt.Println("Usage : ./serveur [-psk fichier] [-identites fichier] [-racine dossier] [-filtre fichier] [-ecoute adresse|interface] [-reseau udp|udp4|udp6] [-mss octets] [-depot] [-depotMax octets] [-stats ligne|json|aucun] [-metriques adresse] [-journal niveau] [-suivre ip,...] [-trace dossier] [-capture fichier] [-emulation réglages] <port>")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		return
 	}
-	if len(arguments) > 2 {
-		fmt.Println("Usage : ./serveur <port>")
+	if err := reglerJournal(*niveau); err != nil {
+		fmt.Println(err)
 		return
 	}
-	PORT := ":" + arguments[1]
-
-	//On récupère l'adresse de l'UDP endpoint (endpoint=IP:port)
-	s, err := net.ResolveUDPAddr("udp4", PORT)
-	if err != nil {
+	if err := suivre(*suivis); err != nil {
 		fmt.Println(err)
 		return
 	}
-	//On créé un serveur UDP
-	connection, err := net.ListenUDP("udp4", s)
+	emulation, err := lireEmulation(*reglagesReseau)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer connection.Close()
-
-	//On crée et initialise un objet buffer de type []byte et taille 1500
-	buffer := make([]byte, 1500)
-	new_port := 1024 //on commence à 1024 et pas 1000 car les 1024 sont limités pour les utilisateurs normaux (non root par exemple)
-
-	//Création d'une map de connections ouvertes : clé = ip:port_init ; valeur = connexion
-	current_conn := make(map[string]*net.UDPConn)
 
-	for {
-
-		//On lit le message recu et on le met dans le buffer
-		_, addr, err := connection.ReadFromUDP(buffer)
-		//fmt.Println("adresse addr", addr)
-		//fmt.Println("Buffer, ", string(buffer))
-
-		if err != nil { //Gestion en cas d'erreur
+	//Avec une clé partagée, on refuse les clients qui ne chiffrent pas
+	var psk []byte
+	if *fichierPSK != "" {
+		cle, err := lireCle(*fichierPSK)
+		if err != nil {
 			fmt.Println(err)
 			return
+		}
+		psk = cle
+	}
 
-			/* si l'adresse de connexion n'est pas dans la map :
-			- on vérifie que le client nous a envoyé un SYN
-			- si oui on ajoute l'adresse à la map
-			- sinon on s'en fiche de ce client */
-		} else if _, found := current_conn[addr.String()]; !found {
-
-			if strings.Contains(string(buffer), "SYN") {
-
-				//fmt.Println("-------------------------------------")
-				//fmt.Println("--------THREE-WAY HANDSHAKE----------")
-				//fmt.Println("-------------------------------------")
-
-				//Si le message recu est un SYN
-				//fmt.Print("Received message ", string(buffer), "\n")
-				//fmt.Println("Sending SYN_ACK...")
-
-				/*------OUVERTURE DE LA CONNEXION SUR LE NOUVEAU PORT------ */
-				add, err := net.ResolveUDPAddr("udp4", (":" + strconv.Itoa(new_port)))
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-
-				conn, err := net.ListenUDP("udp4", add)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-
-				defer conn.Close()
-				current_conn[addr.String()] = conn
-
-				//Le serveur est pret : on envoie le SYN-ACK avec le nouveau port
-				_, _ = connection.WriteToUDP([]byte("SYN-ACK"+strconv.Itoa(new_port)), addr)
-
-				new_port += 1 //on incrémente le new_port de 1 pour la prochaine connexion
-
-				if new_port == 9999 { //si on arrive à la fin de la plage de port, on reboucle au début de cette plage
-					new_port = 1024
-				}
-			}
+	//Avec un fichier d'identités, seuls les clients qui y figurent sont servis
+	var identites map[string]*identite
+	if *fichierIdentites != "" {
+		ids, err := lireIdentites(*fichierIdentites)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		identites = ids
+	}
 
-		} else if strings.Contains(string(buffer), "ACK") { //on prend en compte les ACK que des clients connus (adresse présente dans la map)
+	//Règles de filtrage et limites de connexions, relues à chaque SIGHUP
+	filtre := new(atomic.Pointer[regles])
+	filtre.Store(&regles{})
+	if *fichierFiltre != "" {
+		r, err := lireFiltre(*fichierFiltre)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		filtre.Store(r)
+		rechargerFiltre(*fichierFiltre, filtre)
+	}
 
-			//fmt.Println("Received message :", string(buffer))
-			//fmt.Println("Three-way handshake established !")
-			//fmt.Println("-------------------------------------")
+	//Les fichiers ne sont lus que dans le dossier servi
+	racine, err := os.OpenRoot(*dossier)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer racine.Close()
 
-			go file(*current_conn[addr.String()], *addr)
+	//On récupère l'adresse de l'UDP endpoint (endpoint=IP:port)
+	s, err := adresseEcoute(*reseau, *ecoute, flag.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	//Avec -capture, tout ce qui passe par les sockets du serveur est enregistré
+	var pcap *capture
+	if *fichierCapture != "" {
+		if pcap, err = ouvrirCapture(*fichierCapture); err != nil {
+			fmt.Println(err)
+			return
 		}
+		defer pcap.fermer()
+	}
 
+	//On créé un serveur UDP
+	udp, err := net.ListenUDP(*reseau, s)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	connection := &socketEcoute{UDPConn: udp, conn: capturer(emuler(udp, emulation), pcap)}
+	defer connection.Close()
+	connection.fermerAuSignal()
+
+	//Création du registre des connections ouvertes : clé = ip:port_init ; valeur = connexion
+	srv := &serveur{reseau: *reseau, adresse: s, psk: psk, identites: identites, filtre: filtre, racine: racine, depot: *depot, depotMax: *depotMax, mss: *mss, emulation: emulation, pcap: pcap, trace: *dossierTrace, connexions: nouveauRegistre()}
+
+	//Les jauges sont relevées à chaque lecture des métriques
+	if *adresseMetriques != "" {
+		servirMetriques(*adresseMetriques, func() {
+			ouvertes := float64(srv.connexions.nombre())
+			metriqueConnexions.fixer("", ouvertes)
+			metriquePorts.fixer("", ouvertes)
+		})
 	}
 
+	//^C ferme la socket d'écoute : les connexions en cours sont interrompues, puis les defer
+	//ferment la capture et le dossier servi
+	if err := srv.accueillir(connection); errors.Is(err, net.ErrClosed) {
+		journal.Info("serveur arrêté")
+	} else {
+		journal.Error("écoute interrompue", "err", err)
+	}
+	srv.arreter()
 }
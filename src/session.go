@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------------SESSIONS--------------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec l'option "session", la connexion reste ouverte après un transfert et
+sert plusieurs fichiers. Les demandes sont alors numérotées à partir de 1 :
+	GET <numéro> <nom>\0
+	PUT <numéro> <nom>\0   (si "put" est aussi négocié)
+	LIST <numéro> <dossier>\0, STAT <numéro> <nom>\0   (si "liste" est aussi négocié)
+	CLOSE
+Le client peut envoyer plusieurs demandes d'un coup : le serveur les garde et
+les sert dans l'ordre des numéros, une demande déjà servie est ignorée. Il
+ferme la session à la réception de CLOSE ou après dureeSession sans demande.
+
+Pour qu'un segment ou un ACK retardé d'un transfert ne soit pas pris pour un
+segment du suivant, les numéros de séquence continuent d'un transfert à
+l'autre : le premier segment d'un transfert suit le dernier du précédent.
+META et FIN portent le numéro de la demande qu'ils servent ("req=<numéro>")
+et sont ignorés s'ils ne correspondent pas au transfert en cours. Un ACK du dernier segment reçu
+pendant que le serveur attend la demande suivante fait renvoyer le FIN : il
+s'était perdu (hors session, le serveur attend de même delaiFermeture avant de
+fermer). Les numéros restant sur 6 chiffres, une session ne dépasse pas
+seqMax segments ; au-delà, il faut en ouvrir une nouvelle. */
+
+// au-delà de cette durée sans demande, le serveur ferme la session
+const dureeSession = 30 * time.Second
+
+// hors session, durée sans nouvelles du client après le FIN avant de fermer : le
+// client rappelle son dernier ACK toutes les delaiControle s'il n'a pas eu le FIN :
+// trois rappels de suite peuvent se perdre, le quatrième arrive encore à temps
+// (avec un délai de deux rappels, la simulation perdait des FIN)
+const delaiFermeture = 5 * delaiControle
+
+// plus grand numéro de séquence sur 6 chiffres
+const seqMax = 999999
+
+// requete est une demande du client
+type requete struct {
+	commande string // GET, PUT, LIST ou STAT
+	nom      string // fichier (ou dossier) demandé
+}
+
+// commandes comprises par le serveur, avec l'option qui les permet ("" : toujours)
+var commandes = map[string]string{"GET": "", "PUT": "put", "LIST": "liste", "STAT": "liste"}
+
+// lireRequete analyse la première demande reçue sur le port de données : un
+// simple nom (comme client1), "<commande> <nom>" si l'option de la commande a
+// été négociée, ou une demande numérotée en session
+func (c *connexion) lireRequete(message string) (requete, bool) {
+	if c.options.a("session") {
+		c.noterRequete(message)
+		return c.requeteSuivante()
+	}
+	if commande, nom, ok := strings.Cut(message, " "); ok {
+		if option := commandes[commande]; option != "" && c.options.a(option) {
+			return requete{commande: commande, nom: nom}, true
+		}
+	}
+	return requete{commande: "GET", nom: message}, true
+}
+
+// noterRequete garde une demande de session pour plus tard ; elle indique si le message en était une
+func (c *connexion) noterRequete(message string) bool {
+	message = nettoyer([]byte(message))
+	if message == "CLOSE" {
+		c.fermeture = true
+		return true
+	}
+	champs := strings.SplitN(message, " ", 3)
+	if _, connue := commandes[champs[0]]; len(champs) != 3 || !connue {
+		return false
+	}
+	numero, err := strconv.Atoi(champs[1])
+	if err != nil {
+		return false
+	}
+	if numero >= c.prochaine { //une demande déjà servie est un doublon
+		if c.requetes == nil {
+			c.requetes = make(map[int]requete)
+		}
+		c.requetes[numero] = requete{commande: champs[0], nom: champs[2]}
+	}
+	return true
+}
+
+// requeteSuivante renvoie la prochaine demande de la session si elle est arrivée
+func (c *connexion) requeteSuivante() (requete, bool) {
+	if c.prochaine == 0 {
+		c.prochaine = 1
+	}
+	r, ok := c.requetes[c.prochaine]
+	if ok {
+		delete(c.requetes, c.prochaine)
+		c.courante = c.prochaine
+		c.prochaine++
+	}
+	return r, ok
+}
+
+// attendreRequete attend la prochaine demande de la session ; faux si le client
+// a fermé la session ou ne demande plus rien
+func (c *connexion) attendreRequete() (requete, bool) {
+	buf := make([]byte, 1024)
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		if r, ok := c.requeteSuivante(); ok {
+			return r, true
+		}
+		if c.fermeture {
+			return requete{}, false
+		}
+		c.conn.SetReadDeadline(c.temps().maintenant().Add(dureeSession))
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			return requete{}, false //session inactive (ou socket fermée)
+		}
+		if !memeAdresse(from, c.addr) {
+			continue
+		}
+		//le client acquitte encore le dernier segment : il n'a pas eu le FIN
+		if !c.noterRequete(string(buf[:n])) && strings.HasPrefix(string(buf[:n]), "ACK") && c.fin != nil {
+			_, _ = c.conn.WriteTo(c.fin, c.addr)
+		}
+	}
+}
+
+// attendreFermeture garde la connexion ouverte après le dernier FIN tant que le
+// client acquitte encore le dernier segment (ou, pour un fichier vide, répète sa
+// demande) : il ne l'a pas reçu, on le renvoie autant de fois que le client peut
+// le redemander. Sans nouvelles pendant delaiFermeture, le client l'a eu.
+func (c *connexion) attendreFermeture() {
+	buf := make([]byte, 1024)
+	defer c.conn.SetReadDeadline(time.Time{})
+	for renvois := 0; c.fin != nil && renvois < essaisInactivite; {
+		c.conn.SetReadDeadline(c.temps().maintenant().Add(delaiFermeture))
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if memeAdresse(from, c.addr) && n > 0 {
+			_, _ = c.conn.WriteTo(c.fin, c.addr)
+			renvois++
+		}
+	}
+}
+
+// marquer ajoute à META ou FIN le numéro de la demande en cours, en session
+func (c *connexion) marquer(message []byte) []byte {
+	if !c.options.a("session") {
+		return message
+	}
+	return fmt.Appendf(message, " req=%d", c.courante)
+}
+
+// duTransfert indique si un META ou un FIN appartient à la demande en cours
+// (hors session, il n'y en a qu'une)
+func (c *connexion) duTransfert(message string) bool {
+	if !c.options.a("session") {
+		return true
+	}
+	champs := strings.Fields(message)
+	if len(champs) == 0 {
+		return false
+	}
+	return lireOptions(champs[1:])["req"] == strconv.Itoa(c.courante)
+}
+
+// errSansSession est renvoyée quand le serveur n'a pas accepté l'option "session"
+var errSansSession = errors.New("le serveur ne gère pas les sessions")
+
+// telechargerSession récupère plusieurs fichiers avec une seule connexion : toutes
+// les demandes partent d'un coup et les fichiers arrivent l'un après l'autre. Elle
+// renvoie les fichiers arrivés corrompus, à redemander.
+func telechargerSession(t telechargement, fichiers []string) ([]string, error) {
+	t.options = maps.Clone(t.options)
+	t.options["session"] = ""
+	conn, dataConn, donnees, opts, err := connecter(t)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if !opts.a("session") {
+		return nil, errSansSession
+	}
+	c := &connexion{conn: dataConn, addr: donnees, options: opts}
+
+	demandes := make([][]byte, len(fichiers))
+	for i, fichier := range fichiers {
+		demandes[i] = fmt.Appendf(nil, "GET %d %s\x00", i+1, fichier)
+		if _, err := dataConn.WriteTo(demandes[i], donnees); err != nil {
+			return nil, err
+		}
+	}
+
+	var corrompus []string
+	for i, fichier := range fichiers {
+		c.courante = i + 1
+		sortie := "copy_" + filepath.Base(fichier)
+		err := recevoirFichier(c, sortie, demandes[i], reglagesReception{progression: t.progression, max: t.max})
+		switch {
+		case err == nil:
+		case errors.Is(err, errIntegrite):
+			//on ne garde jamais un fichier corrompu : il sera redemandé
+			fmt.Println(fichier, ":", err)
+			os.Remove(sortie)
+			corrompus = append(corrompus, fichier)
+		case errors.Is(err, errRefus):
+			fmt.Println(fichier, ":", err)
+			os.Remove(sortie)
+		default:
+			return corrompus, err
+		}
+	}
+	_, _ = dataConn.WriteTo([]byte("CLOSE"), donnees)
+	return corrompus, nil
+}
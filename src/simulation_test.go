@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------------SIMULATION DETERMINISTE------------------ */
+/*-------------------------------------------------------------- */
+
+/* La simulation fait envoyer un fichier par le moteur d'envoi du scénario
+compilé (envoyer, puis l'attente du FIN comme dans traiter) au client Go
+(handshake avec ouvrir, puis recevoirFichier), à travers un réseau émulé (pertes, rafales, latence, gigue,
+désordre, doublons, débit : les liens de emulation.go, et une MTU du chemin
+avec pmtud) et sur une horloge virtuelle. Une seule tâche s'exécute à la
+fois ; le temps n'avance que quand toutes attendent, jusqu'au prochain
+événement, et les événements d'une même date sont traités dans l'ordre où ils
+ont été prévus. Tout ce qui est tiré au hasard (fichier, options, conditions
+du réseau) vient de la graine : une graine rejoue exactement le même
+transfert, trace de l'envoi comprise, bien plus vite qu'en temps réel.
+	make simulation SCENARIO=2 GRAINES=5000   plus de graines
+	make simulation SCENARIO=2 GRAINE=1234    rejoue une graine et affiche ses événements */
+
+var (
+	nbGraines     = flag.Int("graines", 300, "nombre de transferts simulés")
+	graineRejouee = flag.Uint64("graine", 0, "rejoue seulement cette graine et affiche ses événements")
+)
+
+// au-delà de cette durée virtuelle, le transfert est considéré bloqué
+const dureeSimulee = 5 * time.Minute
+
+// événements gardés pour expliquer un échec (tous quand une graine est rejouée)
+const evenementsGardes = 60
+
+// options négociées possibles pour un transfert simulé ("" : comme client1)
+var optionsSimulees = []string{"", "meta crc32c rwnd=256", "meta sha256 crc32c compression=deflate rwnd=256", "mss=9000 meta sha256",
+	"mss=9000 pmtud meta sha256 rwnd=256", "meta crc32c fec=rs rwnd=256", "fec=xor meta sha256"}
+
+// MTU du chemin (taille des plus grands datagrammes UDP qui passent) tirées avec pmtud
+var mtuSimulees = []int{tailleBase, 1472, 4000, 9000}
+
+// evenementSim est ce qui arrive à une date de la simulation : action renvoie la
+// tâche à reprendre, ou nil
+type evenementSim struct {
+	date   time.Time
+	numero int // à date égale, l'ordre où les événements ont été prévus
+	action func() *tacheSim
+}
+
+// fileSim est un tas d'événements, le prochain en tête
+type fileSim []evenementSim
+
+func (f fileSim) Len() int { return len(f) }
+func (f fileSim) Less(i, j int) bool {
+	if f[i].date.Equal(f[j].date) {
+		return f[i].numero < f[j].numero
+	}
+	return f[i].date.Before(f[j].date)
+}
+func (f fileSim) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f *fileSim) Push(x any)   { *f = append(*f, x.(evenementSim)) }
+func (f *fileSim) Pop() any {
+	dernier := (*f)[len(*f)-1]
+	*f = (*f)[:len(*f)-1]
+	return dernier
+}
+
+// tacheSim est une goroutine de la simulation, qui attend son tour sur reveil
+type tacheSim struct {
+	reveil chan struct{}
+}
+
+// simulation est l'horloge (elle implémente horloge) et l'ordonnanceur : la tâche
+// qui a la main est la seule à toucher ses champs, et la passe par un canal
+type simulation struct {
+	graine    uint64
+	hasard    *rand.Rand
+	debut     time.Time
+	present   time.Time
+	file      fileSim
+	numero    int
+	courante  *tacheSim
+	taches    map[*tacheSim]bool
+	arretee   bool
+	erreur    error
+	fini      chan struct{}
+	sortie    chan struct{} // une tâche arrêtée a fini de s'arrêter
+	detail    bool          // garder tous les événements
+	journal   []string
+	empreinte uint64 // des événements, pour vérifier qu'une graine se rejoue à l'identique
+}
+
+func nouvelleSimulation(graine uint64, detail bool) *simulation {
+	debut := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &simulation{graine: graine, hasard: rand.New(rand.NewPCG(graine, 0)), debut: debut, present: debut, taches: make(map[*tacheSim]bool), fini: make(chan struct{}), sortie: make(chan struct{}), detail: detail}
+}
+
+func (s *simulation) maintenant() time.Time { return s.present }
+
+func (s *simulation) dormir(d time.Duration) {
+	moi := s.courante
+	s.planifier(s.present.Add(d), func() *tacheSim { return moi })
+	s.ceder(moi)
+}
+
+func (s *simulation) lancer(f func()) {
+	t := &tacheSim{reveil: make(chan struct{}, 1)}
+	s.taches[t] = true
+	go func() {
+		<-t.reveil
+		//arrêtée par la simulation : on le dit une fois les defer de f exécutés
+		arretee := true
+		defer func() {
+			if arretee {
+				s.sortie <- struct{}{}
+			}
+		}()
+		if s.arretee {
+			return
+		}
+		f() //ou runtime.Goexit si la simulation s'arrête pendant f
+		arretee = false
+		delete(s.taches, t)
+		s.ceder(nil)
+	}()
+	s.planifier(s.present, func() *tacheSim { return t })
+}
+
+func (s *simulation) nouveauReveil() reveil { return &reveilSim{s: s} }
+
+// reveilSim est le réveil de la simulation
+type reveilSim struct {
+	s       *simulation
+	donne   bool      // donné pendant que personne n'attendait
+	attente *tacheSim // tâche qui attend le réveil
+	expire  bool      // l'attente s'est terminée sans le réveil
+	tour    int       // numéro de l'attente, pour ignorer les échéances passées
+}
+
+func (g *reveilSim) donner() {
+	if g.attente == nil {
+		g.donne = true
+		return
+	}
+	t := g.attente
+	g.attente = nil
+	g.tour++
+	g.s.planifier(g.s.present, func() *tacheSim { return t })
+}
+
+func (g *reveilSim) attendre(d time.Duration) bool {
+	if g.donne {
+		g.donne = false
+		return true
+	}
+	moi := g.s.courante
+	g.attente = moi
+	if d >= 0 {
+		tour := g.tour
+		g.s.planifier(g.s.present.Add(d), func() *tacheSim {
+			if g.tour != tour {
+				return nil //déjà donné
+			}
+			g.attente = nil
+			g.tour++
+			g.expire = true
+			return moi
+		})
+	}
+	g.s.ceder(moi)
+	if g.expire {
+		g.expire = false
+		return false
+	}
+	return true
+}
+
+// planifier prévoit action à la date donnée
+func (s *simulation) planifier(date time.Time, action func() *tacheSim) {
+	s.numero++
+	heap.Push(&s.file, evenementSim{date: date, numero: s.numero, action: action})
+}
+
+// ceder rend la main : les événements sont traités dans l'ordre jusqu'à ce qu'une
+// tâche soit à reprendre. Si c'est moi, il continue ; sinon moi attend son tour
+// (moi nil : la tâche se termine, ou n'en est pas une).
+func (s *simulation) ceder(moi *tacheSim) {
+	if s.arretee {
+		//appelée par un defer d'une tâche qui s'arrête : on continue de s'arrêter
+		if moi != nil {
+			runtime.Goexit()
+		}
+		return
+	}
+	for {
+		if len(s.file) == 0 {
+			if len(s.taches) > 0 {
+				s.arreter(fmt.Errorf("interblocage : %d tâche(s) attendent sans échéance", len(s.taches)), moi)
+			} else {
+				s.arreter(nil, moi)
+			}
+			return
+		}
+		e := heap.Pop(&s.file).(evenementSim)
+		if e.date.Sub(s.debut) > dureeSimulee {
+			s.arreter(fmt.Errorf("toujours en cours après %v simulées", dureeSimulee), moi)
+			return
+		}
+		s.present = maxDate(s.present, e.date)
+		t := e.action()
+		if t == nil {
+			continue
+		}
+		s.courante = t
+		if t == moi {
+			return
+		}
+		t.reveil <- struct{}{}
+		break
+	}
+	if moi != nil {
+		<-moi.reveil
+		if s.arretee {
+			runtime.Goexit()
+		}
+	}
+}
+
+// arreter termine la simulation : les tâches qui attendent encore s'arrêtent une à une
+// (moi la première, une fois ses defer exécutés)
+func (s *simulation) arreter(err error, moi *tacheSim) {
+	s.arretee, s.erreur = true, err
+	terminer := func() {
+		for t := range s.taches {
+			if t != moi {
+				t.reveil <- struct{}{}
+				<-s.sortie
+			}
+		}
+		close(s.fini)
+	}
+	if moi == nil {
+		terminer()
+		return
+	}
+	go func() {
+		<-s.sortie
+		terminer()
+	}()
+	runtime.Goexit()
+}
+
+// executer lance f comme première tâche et attend la fin de la simulation
+func (s *simulation) executer(f func()) error {
+	s.lancer(f)
+	s.ceder(nil)
+	<-s.fini
+	return s.erreur
+}
+
+// noter ajoute un événement au journal
+func (s *simulation) noter(format string, args ...any) {
+	ligne := fmt.Sprintf("%10.3fms ", ms(s.present.Sub(s.debut))) + fmt.Sprintf(format, args...)
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d %s", s.empreinte, ligne)
+	s.empreinte = h.Sum64()
+	s.journal = append(s.journal, ligne)
+	if !s.detail && len(s.journal) > evenementsGardes {
+		s.journal = s.journal[len(s.journal)-evenementsGardes:]
+	}
+}
+
+// lienSim est un lien émulé de la simulation, avec ses datagrammes en route
+type lienSim struct {
+	*lien
+	enAttente int
+	mtu       int // plus grand datagramme qui passe (0 : pas de limite)
+}
+
+// transmettre fait traverser le lien à p, qui est remis à livrer à sa date d'arrivée
+func (s *simulation) transmettre(l *lienSim, sens string, p []byte, livrer func([]byte) *tacheSim) {
+	resume := nettoyer(p[:min(len(p), 16)])
+	if l.mtu > 0 && len(p) > l.mtu {
+		s.noter("%s %q (%d octets) trop gros pour le chemin", sens, resume, len(p))
+		return
+	}
+	arrivees := l.tirer(len(p), s.present, l.enAttente)
+	if len(arrivees) == 0 {
+		s.noter("%s %q perdu", sens, resume)
+		return
+	}
+	for i, arrivee := range arrivees {
+		l.enAttente++
+		copie := append([]byte(nil), p...)
+		s.noter("%s %q arrivée à %.3fms%s", sens, resume, ms(arrivee.Sub(s.debut)), map[bool]string{true: " (doublon)"}[i > 0])
+		s.planifier(arrivee, func() *tacheSim {
+			l.enAttente--
+			return livrer(copie)
+		})
+	}
+}
+
+// connSimulee est la socket de données du serveur ou celle du client dans la simulation
+type connSimulee struct {
+	s        *simulation
+	sens     string // pour le journal
+	local    *net.UDPAddr
+	pair     *net.UDPAddr
+	envoi    *lienSim
+	remettre func([]byte) *tacheSim // ce qui arrive au pair
+	recus    []datagramme
+	lecteur  *tacheSim
+	echeance time.Time
+	fermee   bool
+}
+
+func (c *connSimulee) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.fermee {
+		return 0, net.ErrClosed
+	}
+	c.s.transmettre(c.envoi, c.sens, p, c.remettre)
+	return len(p), nil
+}
+
+// deposer reçoit un datagramme du pair, et réveille la tâche qui l'attend
+func (c *connSimulee) deposer(p []byte) *tacheSim {
+	if c.fermee {
+		return nil
+	}
+	c.recus = append(c.recus, datagramme{p, c.pair})
+	t := c.lecteur
+	c.lecteur = nil
+	return t
+}
+
+func (c *connSimulee) ReadFrom(b []byte) (int, net.Addr, error) {
+	s := c.s
+	for {
+		if c.fermee || s.arretee {
+			return 0, nil, net.ErrClosed
+		}
+		if len(c.recus) > 0 {
+			d := c.recus[0]
+			c.recus = c.recus[1:]
+			return copy(b, d.donnees), d.addr, nil
+		}
+		if !c.echeance.IsZero() && !s.present.Before(c.echeance) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		moi := s.courante
+		c.lecteur = moi
+		if !c.echeance.IsZero() {
+			s.planifier(c.echeance, func() *tacheSim {
+				if c.lecteur != moi {
+					return nil //déjà réveillée par un datagramme
+				}
+				c.lecteur = nil
+				return moi
+			})
+		}
+		s.ceder(moi)
+	}
+}
+
+func (c *connSimulee) Close() error {
+	c.fermee = true
+	return nil
+}
+
+func (c *connSimulee) LocalAddr() net.Addr                { return c.local }
+func (c *connSimulee) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *connSimulee) SetWriteDeadline(t time.Time) error { return nil }
+func (c *connSimulee) SetReadDeadline(t time.Time) error {
+	c.echeance = t
+	return nil
+}
+
+// transfertSimule décrit ce que la graine a tiré, et ce qui s'est passé
+type transfertSimule struct {
+	taille    int
+	options   string
+	reseau    *reglagesEmulation
+	duree     time.Duration // durée virtuelle du transfert, jusqu'à ce que le client ait fini
+	evenement uint64        // empreinte des événements
+	trace     []byte        // trace de l'envoi, datée par l'horloge virtuelle
+	mtu       int           // MTU du chemin vers le client (0 : pas de limite)
+	abandon   error         // le serveur a renoncé et l'a dit, le client n'a rien cru reçu
+}
+
+func (t transfertSimule) String() string {
+	r := t.reseau
+	return fmt.Sprintf("%d octets, options %q, perte %.1f%% rafales %.0f%%/%.0f%% delai %v gigue %v desordre %.0f%% double %.0f%% debit %.0f o/s mtu %d",
+		t.taille, t.options, 100*r.perte, 100*r.versMauvais, 100*r.versBon, r.delai, r.gigue, 100*r.desordre, 100*r.double, r.debit, t.mtu)
+}
+
+// tamponTrace garde en mémoire la trace d'un transfert simulé
+type tamponTrace struct{ bytes.Buffer }
+
+func (*tamponTrace) Close() error { return nil }
+
+// tirerConditions tire les conditions du réseau d'un transfert
+func tirerConditions(h *rand.Rand) *reglagesEmulation {
+	r := &reglagesEmulation{perteRafale: 1, file: 1000, envoi: true, reception: true}
+	r.perte = h.Float64() * 0.10
+	if h.IntN(4) == 0 {
+		r.versMauvais, r.versBon = 0.01+h.Float64()*0.02, 0.2+h.Float64()*0.3
+	}
+	r.delai = time.Duration(h.IntN(50)) * time.Millisecond
+	r.gigue = time.Duration(h.Int64N(int64(r.delai)/2 + 1))
+	if h.IntN(3) == 0 {
+		r.desordre = h.Float64() * 0.05
+	}
+	if h.IntN(3) == 0 {
+		r.double = h.Float64() * 0.02
+	}
+	if h.IntN(3) == 0 {
+		r.debit = []float64{1e6, 10e6, 100e6}[h.IntN(3)] / 8
+	}
+	return r
+}
+
+// simuler rejoue la graine : un fichier envoyé par le moteur du scénario compilé et
+// reçu par le client Go dans le dossier donné
+func simuler(graine uint64, detail bool, dossier string) (transfertSimule, []string, error) {
+	s := nouvelleSimulation(graine, detail)
+	h := s.hasard
+	t := transfertSimule{taille: []int{0, 1, 1400, 1500 * 75, h.IntN(300_000)}[h.IntN(5)], options: optionsSimulees[h.IntN(len(optionsSimulees))], reseau: tirerConditions(h)}
+	fichier := make([]byte, t.taille)
+	for i := range fichier {
+		fichier[i] = byte(h.IntN(4)) //un peu de redondance pour la compression
+	}
+	opts := lireOptions(strings.Fields(t.options))
+	if opts.a("pmtud") {
+		t.mtu = mtuSimulees[h.IntN(len(mtuSimulees))]
+	}
+	nouveauLienSim := func(mtu int) *lienSim {
+		return &lienSim{lien: &lien{r: t.reseau, hasard: rand.New(rand.NewPCG(h.Uint64(), h.Uint64()))}, mtu: mtu}
+	}
+
+	adresseServeur := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	adresseClient := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}
+	serveur := &connSimulee{s: s, sens: "serveur ->", local: adresseServeur, pair: adresseClient, envoi: nouveauLienSim(t.mtu)}
+	client := &connSimulee{s: s, sens: "client  ->", local: adresseClient, pair: adresseServeur, envoi: nouveauLienSim(0)}
+	serveur.remettre, client.remettre = client.deposer, serveur.deposer
+
+	var errEnvoi, errReception error
+	recu := filepath.Join(dossier, "recu")
+	trace := &tamponTrace{}
+	err := s.executer(func() {
+		//le serveur, comme accueillir puis traiter : le handshake (sur la même socket),
+		//la demande, l'envoi, puis l'attente d'un FIN redemandé
+		s.lancer(func() {
+			c := &connexion{conn: serveur, addr: adresseClient, options: opts, horloge: s}
+			defer c.conn.Close()
+			var err error
+			if c.trace, err = nouvelleTrace(trace, "server", t.options, s); err != nil {
+				errEnvoi = err
+				return
+			}
+			defer c.trace.fermer()
+			synAck := []byte(strings.TrimSpace(fmt.Sprintf("SYN-ACK%d %v", adresseServeur.Port, opts)))
+			buf := make([]byte, 1024)
+			serveur.SetReadDeadline(s.maintenant().Add(dureeHandshake)) //sinon purger finit par l'oublier
+			for {
+				n, _, err := serveur.ReadFrom(buf)
+				if err != nil {
+					errEnvoi = fmt.Errorf("pas de demande : %v", err)
+					return
+				}
+				message := nettoyer(buf[:n])
+				if strings.HasPrefix(message, "SYN") {
+					_, _ = serveur.WriteTo(synAck, adresseClient) //SYN-ACK perdu : le client renvoie son SYN
+					continue
+				}
+				if message != "ACK" {
+					break //la demande
+				}
+			}
+			serveur.SetReadDeadline(time.Time{})
+			source := &document{Reader: bytes.NewReader(fichier), nom: "simulé", date: s.debut}
+			fin, err := envoyer(c, source, "simulé", reglages, nouvellesStatistiques("simulé", adresseClient, s))
+			if err != nil {
+				errEnvoi = err
+				refuser(c, err)
+			}
+			c.fin = fin
+			c.attendreFermeture()
+		})
+
+		//le client, comme telecharger
+		defer client.Close()
+		donnees, acceptees, err := ouvrir(client, adresseServeur, opts, nil, s)
+		if err != nil {
+			errReception = err
+			return
+		}
+		c := &connexion{conn: client, addr: donnees, options: acceptees, horloge: s}
+		demande := []byte("simulé\x00")
+		if _, err := client.WriteTo(demande, donnees); err != nil {
+			errReception = err
+			return
+		}
+		errReception = recevoirFichier(c, recu, demande, reglagesReception{})
+		t.duree = s.present.Sub(s.debut)
+	})
+	t.evenement = s.empreinte
+	t.trace = trace.Bytes()
+
+	switch {
+	case err != nil:
+	case errReception != nil && errEnvoi != nil && !errors.Is(errReception, errIntegrite):
+		//sous une rafale assez longue, le serveur finit par renoncer : ce n'est pas une erreur
+		//tant qu'il le sait et que le client ne croit pas avoir le fichier
+		t.abandon = errEnvoi
+	case errReception != nil:
+		err = fmt.Errorf("le client a échoué : %v", errReception)
+	case errEnvoi != nil:
+		err = fmt.Errorf("le client a reçu le FIN mais le serveur a échoué : %v", errEnvoi)
+	default:
+		if copie, errLecture := os.ReadFile(recu); errLecture != nil {
+			err = errLecture
+		} else if !bytes.Equal(copie, fichier) {
+			err = fmt.Errorf("%d octets reçus différents des %d envoyés", len(copie), len(fichier))
+		}
+	}
+	return t, s.journal, err
+}
+
+func TestSimulation(t *testing.T) {
+	if *graineRejouee != 0 {
+		transfert, journal, err := simuler(*graineRejouee, true, t.TempDir())
+		for _, ligne := range journal {
+			t.Log(ligne)
+		}
+		t.Logf("graine %d (scénario %s) : %v, %v simulées", *graineRejouee, scenario, transfert, transfert.duree)
+		if transfert.abandon != nil {
+			t.Logf("abandon du serveur : %v", transfert.abandon)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	debut := time.Now()
+	dossier := t.TempDir()
+	var simule time.Duration
+	abandons := 0
+	for graine := uint64(1); graine <= uint64(*nbGraines); graine++ {
+		transfert, journal, err := simuler(graine, false, dossier)
+		simule += transfert.duree
+		if transfert.abandon != nil {
+			abandons++
+		}
+		if err != nil {
+			t.Errorf("graine %d : %v\n  %v\n  derniers événements :\n    %s\n  rejouer : make simulation SCENARIO=%s GRAINE=%d",
+				graine, err, transfert, strings.Join(journal, "\n    "), scenario, graine)
+		}
+	}
+	t.Logf("scénario %s : %d transferts (%d abandonnés par le serveur), %v simulées en %v",
+		scenario, *nbGraines, abandons, simule.Round(time.Second), time.Since(debut).Round(time.Millisecond))
+}
+
+// une graine rejouée refait exactement les mêmes événements, et écrit la même trace
+func TestSimulationReproductible(t *testing.T) {
+	dossier := t.TempDir()
+	for graine := uint64(1); graine <= 20; graine++ {
+		premier, _, err1 := simuler(graine, false, dossier)
+		second, _, err2 := simuler(graine, false, dossier)
+		if premier.evenement != second.evenement || premier.duree != second.duree || fmt.Sprint(err1) != fmt.Sprint(err2) {
+			t.Errorf("graine %d : %v puis %v simulées, événements %x puis %x", graine, premier.duree, second.duree, premier.evenement, second.evenement)
+		}
+		if !bytes.Equal(premier.trace, second.trace) {
+			t.Errorf("graine %d : traces différentes (%d puis %d octets)", graine, len(premier.trace), len(second.trace))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*-------------------STATISTIQUES D'UN ENVOI-------------------- */
+/*-------------------------------------------------------------- */
+
+/* Chaque envoi remplit ses statistiques au fil de l'eau : des compteurs
+atomiques, et un verrou pour les RTT et la fenêtre, que les deux goroutines du
+moteur d'envoi mettent à jour. bilan en prend une photo à tout moment (même
+pendant l'envoi) ; à la fin, elle est affichée en une ligne ou en JSON. */
+
+// intervalle entre deux relevés de la fenêtre
+const periodeFenetre = 100 * time.Millisecond
+
+// nombre maximal de relevés de la fenêtre gardés (les plus anciens d'abord)
+const relevesMax = 600
+
+// statistiques d'un envoi, côté émetteur
+type statistiques struct {
+	fichier string
+	pair    net.Addr
+	h       horloge // horloge de la connexion
+	debut   time.Time
+
+	octets        atomic.Int64 // octets envoyés (segments, renvois compris)
+	segments      atomic.Int64 // segments envoyés, renvois compris
+	renvois       atomic.Int64 // segments envoyés plus d'une fois
+	acksDupliques atomic.Int64
+	timeouts      atomic.Int64
+	nacks         atomic.Int64 // segments arrivés corrompus et renvoyés
+	utiles        atomic.Int64 // octets du fichier acquittés à la fin
+
+	mu        sync.Mutex
+	fin       time.Time
+	envois    map[int]time.Time // date du premier envoi de chaque segment non acquitté
+	renvoyes  map[int]bool      // segments renvoyés : leur ACK ne mesure pas le RTT (Karn)
+	rttMin    time.Duration
+	rttMax    time.Duration
+	rttSomme  time.Duration
+	rttNombre int
+	releves   []releve
+	dernier   time.Time // date du dernier relevé
+}
+
+// releve est l'état de la fenêtre à un instant de l'envoi
+type releve struct {
+	Temps  float64 `json:"t_ms"`   // depuis le début de l'envoi
+	EnVol  int     `json:"en_vol"` // segments envoyés et pas encore acquittés
+	Client int     `json:"rwnd"`   // fenêtre annoncée par le destinataire (-1 : inconnue)
+}
+
+// bilan est la photo des statistiques d'un envoi
+type bilan struct {
+	Fichier       string   `json:"fichier"`
+	Pair          string   `json:"pair"`
+	Duree         float64  `json:"duree_s"`
+	Octets        int64    `json:"octets_envoyes"`
+	Utiles        int64    `json:"octets_utiles"`
+	Debit         float64  `json:"debit_utile"` // octets utiles par seconde
+	Segments      int64    `json:"segments"`
+	Renvois       int64    `json:"renvois"`
+	AcksDupliques int64    `json:"acks_dupliques"`
+	Timeouts      int64    `json:"timeouts"`
+	Nacks         int64    `json:"nacks"`
+	RttMin        float64  `json:"rtt_min_ms"`
+	RttMoyen      float64  `json:"rtt_moy_ms"`
+	RttMax        float64  `json:"rtt_max_ms"`
+	Fenetre       []releve `json:"fenetre"`
+}
+
+func nouvellesStatistiques(fichier string, pair net.Addr, h horloge) *statistiques {
+	return &statistiques{fichier: fichier, pair: pair, h: h, debut: h.maintenant(), envois: make(map[int]time.Time), renvoyes: make(map[int]bool)}
+}
+
+// envoi note l'envoi du segment num, de taille octets
+func (s *statistiques) envoi(num int, taille int) {
+	s.octets.Add(int64(taille))
+	s.segments.Add(1)
+	metriqueOctets.ajouter("", float64(taille))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.envois[num]; ok {
+		s.renvoyes[num] = true
+		s.renvois.Add(1)
+		metriqueRenvois.ajouter("", 1)
+		return
+	}
+	s.envois[num] = s.h.maintenant()
+}
+
+// timeout note un délai de retransmission expiré
+func (s *statistiques) timeout() {
+	s.timeouts.Add(1)
+	metriqueRTO.ajouter("", 1)
+}
+
+// acquitte note que le destinataire a tout reçu jusqu'au segment num
+func (s *statistiques) acquitte(num int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if envoi, ok := s.envois[num]; ok && !s.renvoyes[num] {
+		rtt := s.h.maintenant().Sub(envoi)
+		if s.rttNombre == 0 || rtt < s.rttMin {
+			s.rttMin = rtt
+		}
+		s.rttMax = max(s.rttMax, rtt)
+		s.rttSomme += rtt
+		s.rttNombre++
+	}
+	for n := range s.envois {
+		if n <= num {
+			delete(s.envois, n)
+			delete(s.renvoyes, n)
+		}
+	}
+}
+
+// fenetre relève l'état de la fenêtre, au plus une fois par periodeFenetre
+func (s *statistiques) fenetre(enVol int, rwnd int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.h.maintenant().Sub(s.dernier) < periodeFenetre {
+		return
+	}
+	s.dernier = s.h.maintenant()
+	if rwnd == fenetreInconnue {
+		rwnd = -1
+	}
+	if len(s.releves) == relevesMax {
+		s.releves = s.releves[1:]
+	}
+	s.releves = append(s.releves, releve{Temps: ms(s.dernier.Sub(s.debut)), EnVol: enVol, Client: rwnd})
+}
+
+// terminer arrête le chronomètre, une fois les octets utiles tous acquittés
+func (s *statistiques) terminer(utiles int64) {
+	s.utiles.Store(utiles)
+	s.mu.Lock()
+	s.fin = s.h.maintenant()
+	s.mu.Unlock()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// bilan renvoie l'état des statistiques, pendant l'envoi ou à la fin
+func (s *statistiques) bilan() bilan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fin := s.fin
+	if fin.IsZero() {
+		fin = s.h.maintenant()
+	}
+	b := bilan{
+		Fichier:       s.fichier,
+		Pair:          s.pair.String(),
+		Duree:         fin.Sub(s.debut).Seconds(),
+		Octets:        s.octets.Load(),
+		Utiles:        s.utiles.Load(),
+		Segments:      s.segments.Load(),
+		Renvois:       s.renvois.Load(),
+		AcksDupliques: s.acksDupliques.Load(),
+		Timeouts:      s.timeouts.Load(),
+		Nacks:         s.nacks.Load(),
+		RttMin:        ms(s.rttMin),
+		RttMax:        ms(s.rttMax),
+		Fenetre:       append([]releve(nil), s.releves...),
+	}
+	if b.Duree > 0 {
+		b.Debit = float64(b.Utiles) / b.Duree
+	}
+	if s.rttNombre > 0 {
+		b.RttMoyen = ms(s.rttSomme / time.Duration(s.rttNombre))
+	}
+	return b
+}
+
+// String résume l'envoi en une ligne
+func (b bilan) String() string {
+	return fmt.Sprintf("%s -> %s : %d octets en %.3fs (%.1f Ko/s), %d segments, %d renvois, %d ACK dupliqués, %d timeouts, %d NACK, RTT %.2f/%.2f/%.2f ms",
+		b.Fichier, b.Pair, b.Utiles, b.Duree, b.Debit/1000, b.Segments, b.Renvois, b.AcksDupliques, b.Timeouts, b.Nacks, b.RttMin, b.RttMoyen, b.RttMax)
+}
+
+// afficher écrit le bilan de l'envoi : "ligne", "json", ou rien pour un autre format
+func (s *statistiques) afficher(format string) {
+	switch format {
+	case "ligne":
+		fmt.Println(s.bilan())
+	case "json":
+		if j, err := json.Marshal(s.bilan()); err == nil {
+			fmt.Println(string(j))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*-----------------------TRACE DES ENVOIS----------------------- */
+/*-------------------------------------------------------------- */
+
+/* Avec -trace, chaque connexion écrit ses événements dans un fichier, un
+objet JSON par ligne, sur le modèle de qlog (JSON-SEQ sans séparateur RS).
+La première ligne décrit la trace :
+	{"qlog_version":"0.3","qlog_format":"JSON-SEQ","title":..,"trace":{"vantage_point":{"type":"server"},"common_fields":{"reference_time":<unix ms>,"time_format":"relative"}}}
+puis un événement par ligne, "time" en millisecondes depuis reference_time :
+	{"time":12.5,"name":"transport:packet_sent","data":{"seq":42,"taille":1472,"renvoi":false}}
+Événements (seq est le numéro de séquence du segment sur le réseau) :
+	transfer:start           fichier, taille, segments (maximum), chunk
+	transport:packet_sent    seq, taille, renvoi
+	transport:packet_received type (ACK, NACK), seq, rwnd si annoncée ; ou type ACKPMTU, taille de la sonde
+	recovery:packet_lost     seq, declencheur (timeout, acks_dupliques, nack)
+	recovery:metrics_updated borne_inf, borne_sup, prochain, acquitte, en_vol, rwnd (-1 : inconnue)
+	transport:fin_sent       seq (dernier segment acquitté)
+Avec l'option "flux", data porte aussi le numéro du flux. trace2csv en tire les
+courbes numéro de séquence / temps et fenêtre / temps. */
+
+// evenement est une ligne de la trace
+type evenement struct {
+	Temps float64        `json:"time"`
+	Nom   string         `json:"name"`
+	Data  map[string]any `json:"data"`
+}
+
+// enteteTrace est la première ligne de la trace
+type enteteTrace struct {
+	Version string `json:"qlog_version"`
+	Format  string `json:"qlog_format"`
+	Titre   string `json:"title"`
+	Trace   struct {
+		Point struct {
+			Type string `json:"type"`
+		} `json:"vantage_point"`
+		Communs struct {
+			Reference int64  `json:"reference_time"`
+			Temps     string `json:"time_format"`
+		} `json:"common_fields"`
+	} `json:"trace"`
+}
+
+// sortieTrace est le fichier partagé par la connexion et ses flux
+type sortieTrace struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	f     io.Closer
+	h     horloge // horloge de la connexion : les événements sont datés par elle
+	debut time.Time
+}
+
+// traceur écrit les événements d'une connexion (ou d'un de ses flux) ; nil : pas de trace
+type traceur struct {
+	sortie   *sortieTrace
+	flux     int
+	mu       sync.Mutex
+	plusHaut int    // plus grand segment déjà envoyé, pour reconnaître les renvois
+	fenetre  [6]int // dernier état de la fenêtre écrit
+}
+
+// nouvelleTrace écrit l'en-tête de la trace sur w ; point est "server" ou "client"
+func nouvelleTrace(w io.WriteCloser, point, titre string, h horloge) (*traceur, error) {
+	s := &sortieTrace{w: bufio.NewWriter(w), f: w, h: h, debut: h.maintenant()}
+	var e enteteTrace
+	e.Version, e.Format, e.Titre = "0.3", "JSON-SEQ", titre
+	e.Trace.Point.Type = point
+	e.Trace.Communs.Reference = s.debut.UnixMilli()
+	e.Trace.Communs.Temps = "relative"
+	if err := json.NewEncoder(s.w).Encode(e); err != nil {
+		return nil, err
+	}
+	return &traceur{sortie: s}, nil
+}
+
+// ouvrirTrace crée dans dossier la trace d'une connexion entre local et pair
+// (nommée d'après l'adresse du pair, le port local et la date donnée par h)
+func ouvrirTrace(dossier, point string, local, pair net.Addr, h horloge) (*traceur, error) {
+	_, port, _ := net.SplitHostPort(local.String())
+	nom := fmt.Sprintf("%s-%s-%s.qlog", strings.NewReplacer(":", "_", "[", "", "]", "").Replace(pair.String()), port, h.maintenant().Format("20060102T150405.000"))
+	f, err := os.Create(filepath.Join(dossier, nom))
+	if err != nil {
+		return nil, err
+	}
+	return nouvelleTrace(f, point, pair.String(), h)
+}
+
+// pourFlux renvoie le traceur d'un flux de la connexion, qui écrit dans le même fichier
+func (t *traceur) pourFlux(numero int) *traceur {
+	if t == nil {
+		return nil
+	}
+	return &traceur{sortie: t.sortie, flux: numero}
+}
+
+// ecrire ajoute un événement à la trace
+func (t *traceur) ecrire(nom string, data map[string]any) {
+	if t.flux > 0 {
+		data["flux"] = t.flux
+	}
+	s := t.sortie
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = json.NewEncoder(s.w).Encode(evenement{Temps: ms(s.h.maintenant().Sub(s.debut)), Nom: nom, Data: data})
+}
+
+// fermer termine la trace (celle de la connexion, pas d'un flux)
+func (t *traceur) fermer() error {
+	if t == nil {
+		return nil
+	}
+	s := t.sortie
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// debutEnvoi note le début de l'envoi d'un fichier
+func (t *traceur) debutEnvoi(fichier string, taille int64, segments, chunk int) {
+	if t == nil {
+		return
+	}
+	t.ecrire("transfer:start", map[string]any{"fichier": fichier, "taille": taille, "segments": segments, "chunk": chunk})
+}
+
+// envoi note l'envoi du segment seq
+func (t *traceur) envoi(seq, taille int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	renvoi := seq <= t.plusHaut
+	t.plusHaut = max(t.plusHaut, seq)
+	t.mu.Unlock()
+	t.ecrire("transport:packet_sent", map[string]any{"seq": seq, "taille": taille, "renvoi": renvoi})
+}
+
+// reception note un ACK ou un NACK du destinataire ; rwnd < 0 s'il ne l'annonce pas
+func (t *traceur) reception(genre string, seq, rwnd int) {
+	if t == nil {
+		return
+	}
+	data := map[string]any{"type": genre, "seq": seq}
+	if rwnd >= 0 {
+		data["rwnd"] = rwnd
+	}
+	t.ecrire("transport:packet_received", data)
+}
+
+// sonde note que le destinataire a reçu une sonde de taille (recherche de PMTU)
+func (t *traceur) sonde(taille int) {
+	if t == nil {
+		return
+	}
+	t.ecrire("transport:packet_received", map[string]any{"type": "ACKPMTU", "taille": taille})
+}
+
+// perte note un segment considéré perdu, et ce qui l'a fait renvoyer
+func (t *traceur) perte(seq int, declencheur string) {
+	if t == nil {
+		return
+	}
+	t.ecrire("recovery:packet_lost", map[string]any{"seq": seq, "declencheur": declencheur})
+}
+
+// etatFenetre note l'état de la fenêtre d'envoi, s'il a changé
+func (t *traceur) etatFenetre(borneInf, borneSup, prochain, acquitte, rwnd int) {
+	if t == nil {
+		return
+	}
+	if rwnd == fenetreInconnue {
+		rwnd = -1
+	}
+	etat := [6]int{borneInf, borneSup, prochain, acquitte, prochain - 1 - acquitte, rwnd}
+	t.mu.Lock()
+	change := etat != t.fenetre
+	t.fenetre = etat
+	t.mu.Unlock()
+	if change {
+		t.ecrire("recovery:metrics_updated", map[string]any{"borne_inf": borneInf, "borne_sup": borneSup, "prochain": prochain, "acquitte": acquitte, "en_vol": max(etat[4], 0), "rwnd": rwnd})
+	}
+}
+
+// finEnvoi note l'envoi du FIN, et écrit la trace de l'envoi sur le disque
+func (t *traceur) finEnvoi(seq int) {
+	if t == nil {
+		return
+	}
+	t.ecrire("transport:fin_sent", map[string]any{"seq": seq})
+	t.sortie.mu.Lock()
+	_ = t.sortie.w.Flush()
+	t.sortie.mu.Unlock()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+/*-------------------------------------------------------------- */
+/*--------------------------FONCTIONS--------------------------- */
+/*-------------------------------------------------------------- */
+
+// colonnes de la courbe fenêtre / temps, dans l'ordre, après le temps et le flux
+var colonnesFenetre = []string{"borne_inf", "borne_sup", "prochain", "acquitte", "en_vol", "rwnd"}
+
+// ligneSeq traduit un événement en une ligne de la courbe numéro de séquence / temps (nil : aucune)
+func ligneSeq(e evenement) []string {
+	var genre string
+	switch e.Nom {
+	case "transport:packet_sent":
+		genre = "envoi"
+		if renvoi, _ := e.Data["renvoi"].(bool); renvoi {
+			genre = "renvoi"
+		}
+	case "transport:packet_received":
+		genre, _ = e.Data["type"].(string)
+		if genre == "ACKPMTU" {
+			return nil //taille de sonde, pas un numéro de séquence
+		}
+	case "recovery:packet_lost":
+		declencheur, _ := e.Data["declencheur"].(string)
+		genre = "perte_" + declencheur
+	case "transport:fin_sent":
+		genre = "fin"
+	default:
+		return nil
+	}
+	return []string{formaterTemps(e.Temps), champ(e, "flux"), genre, champ(e, "seq")}
+}
+
+// ligneFenetre traduit un événement en une ligne de la courbe fenêtre / temps (nil : aucune)
+func ligneFenetre(e evenement) []string {
+	if e.Nom != "recovery:metrics_updated" {
+		return nil
+	}
+	ligne := []string{formaterTemps(e.Temps), champ(e, "flux")}
+	for _, nom := range colonnesFenetre {
+		ligne = append(ligne, champ(e, nom))
+	}
+	return ligne
+}
+
+// champ renvoie un nombre de l'événement ("0" s'il n'y est pas, comme le flux d'une connexion sans flux)
+func champ(e evenement, nom string) string {
+	v, _ := e.Data[nom].(float64)
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formaterTemps(t float64) string {
+	return strconv.FormatFloat(t, 'f', 3, 64)
+}
+
+// convertir lit la trace et écrit en CSV les lignes que traduire en tire
+func convertir(trace io.Reader, sortie io.Writer, entete []string, traduire func(evenement) []string) error {
+	lecteur := bufio.NewScanner(trace)
+	lecteur.Buffer(make([]byte, 64*1024), 1024*1024)
+	w := csv.NewWriter(sortie)
+	if err := w.Write(entete); err != nil {
+		return err
+	}
+	premiere := true
+	for numero := 1; lecteur.Scan(); numero++ {
+		//la première ligne décrit la trace, elle n'a pas de "name"
+		if premiere {
+			premiere = false
+			var e enteteTrace
+			if err := json.Unmarshal(lecteur.Bytes(), &e); err != nil || e.Format != "JSON-SEQ" {
+				return fmt.Errorf("ligne %d : ce n'est pas une trace", numero)
+			}
+			continue
+		}
+		var e evenement
+		if err := json.Unmarshal(lecteur.Bytes(), &e); err != nil {
+			return fmt.Errorf("ligne %d : %v", numero, err)
+		}
+		if ligne := traduire(e); ligne != nil {
+			if err := w.Write(ligne); err != nil {
+				return err
+			}
+		}
+	}
+	if err := lecteur.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+/*-------------------------------------------------------------- */
+/*-----------------------------MAIN----------------------------- */
+/*-------------------------------------------------------------- */
+
+func main() {
+	fenetre := flag.Bool("fenetre", false, "écrire la courbe fenêtre / temps au lieu de numéro de séquence / temps")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage : ./trace2csv [-fenetre] <trace.qlog> > courbe.csv")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	trace, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer trace.Close()
+
+	//numéro de séquence / temps : un point par envoi, ACK, perte ; fenêtre / temps : un point par changement
+	entete, traduire := []string{"temps_ms", "flux", "evenement", "seq"}, ligneSeq
+	if *fenetre {
+		entete, traduire = append([]string{"temps_ms", "flux"}, colonnesFenetre...), ligneFenetre
+	}
+	if err := convertir(trace, os.Stdout, entete, traduire); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
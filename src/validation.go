@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*-------------------------------------------------------------- */
+/*---------------VALIDATION DES ADRESSES ET ANTI-REJEU---------- */
+/*-------------------------------------------------------------- */
+
+/* Un SYN peut venir d'une adresse usurpée : tant que le client n'a pas prouvé
+qu'il reçoit ce qu'on envoie à son adresse, le serveur ne lui envoie pas plus
+de facteurAmplification fois ce qu'il a reçu de lui.
+
+Le client prouve qu'il est joignable en renvoyant ce qu'il n'a pu lire que
+dans le SYN-ACK :
+- un client qui a envoyé des options reçoit "jeton=<hex>" et doit le
+  renvoyer dans son ACK ("ACK jeton=<hex>") ;
+- client1 et client2 ne savent pas le faire : c'est leur demande de fichier,
+  arrivée sur le port de données tiré au hasard et annoncé dans le SYN-ACK,
+  qui vaut preuve.
+Un jeton ne sert qu'une fois : un ACK rejoué pour une connexion déjà lancée
+est ignoré. Sur une connexion chiffrée, un datagramme dont le numéro de paquet
+a déjà été vu est jeté. */
+
+const facteurAmplification = 3
+
+// de quoi répondre "SYN-ACK<port>" à un simple "SYN" de client1
+const budgetInitial = 16
+
+// taille minimale d'un SYN avec options, pour que la réponse tienne dans le budget
+const tailleSynMin = 256
+
+// plage des ports de données (on commence à 1024 car les ports en dessous sont réservés à root)
+const portMin, portMax = 1024, 9999
+
+// durée pendant laquelle on se souvient des nonces de handshake
+const dureeRejeu = 2 * time.Minute
+
+// budget compte ce qui a été échangé avec une adresse pas encore validée
+type budget struct {
+	mu      sync.Mutex
+	recus   int
+	envoyes int
+	valide  bool
+}
+
+// recevoir ajoute n octets reçus du client
+func (b *budget) recevoir(n int) {
+	b.mu.Lock()
+	b.recus += n
+	b.mu.Unlock()
+}
+
+// depenser indique si n octets peuvent être envoyés au client, et les compte
+func (b *budget) depenser(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.valide && b.envoyes+n > budgetInitial+facteurAmplification*b.recus {
+		return false
+	}
+	b.envoyes += n
+	return true
+}
+
+// valider lève la limite : le client a prouvé qu'il est joignable
+func (b *budget) valider() {
+	b.mu.Lock()
+	b.valide = true
+	b.mu.Unlock()
+}
+
+func (b *budget) estValide() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.valide
+}
+
+// verifierJeton indique si l'ACK du handshake renvoie le jeton du SYN-ACK
+func verifierJeton(ack string, jeton string) bool {
+	champs := strings.Fields(ack)
+	return len(champs) > 0 && lireOptions(champs[1:])["jeton"] == jeton
+}
+
+// rembourrer complète un SYN avec options jusqu'à tailleSynMin octets
+func rembourrer(syn string) string {
+	if manque := tailleSynMin - len(syn) - len(" pad="); manque > 0 {
+		syn += " pad=" + strings.Repeat("0", manque)
+	}
+	return syn
+}
+
+// ouvrirPortDonnees ouvre la socket de données d'un client sur un port tiré au hasard,
+// à l'adresse d'écoute du serveur
+func ouvrirPortDonnees(reseau string, ecoute *net.UDPAddr) (*net.UDPConn, int, error) {
+	var err error
+	for essai := 0; essai < 20; essai++ {
+		tirage, _ := rand.Int(rand.Reader, big.NewInt(portMax-portMin))
+		port := portMin + int(tirage.Int64())
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP(reseau, &net.UDPAddr{IP: ecoute.IP, Port: port, Zone: ecoute.Zone})
+		if err == nil {
+			return conn, port, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// connBornee applique le budget d'un client à sa socket de données : ce qui le
+// dépasse n'est pas envoyé, comme un paquet perdu
+type connBornee struct {
+	net.PacketConn
+	client net.Addr
+	budget *budget
+}
+
+func borner(conn net.PacketConn, client net.Addr, b *budget) net.PacketConn {
+	return &connBornee{PacketConn: conn, client: client, budget: b}
+}
+
+func (c *connBornee) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.budget.depenser(len(p)) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *connBornee) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && memeAdresse(addr, c.client) {
+		c.budget.recevoir(n)
+	}
+	return n, addr, err
+}
+
+// fenetreRejeu retient les numéros de paquet déjà reçus (fenêtre glissante de 64)
+type fenetreRejeu struct {
+	mu       sync.Mutex
+	plusHaut uint64 // plus grand numéro reçu + 1 (0 : rien reçu)
+	vus      uint64 // bit i : plusHaut-1-i a été reçu
+}
+
+// nouveau indique si le numéro n'a jamais été vu, et le retient
+func (f *fenetreRejeu) nouveau(numero uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	suivant := numero + 1
+	switch {
+	case suivant > f.plusHaut:
+		decalage := suivant - f.plusHaut
+		if decalage >= 64 {
+			f.vus = 0
+		} else {
+			f.vus <<= decalage
+		}
+		f.vus |= 1
+		f.plusHaut = suivant
+		return true
+	case f.plusHaut-suivant >= 64:
+		return false //trop vieux pour savoir : on le traite comme un rejeu
+	default:
+		bit := uint64(1) << (f.plusHaut - suivant)
+		if f.vus&bit != 0 {
+			return false
+		}
+		f.vus |= bit
+		return true
+	}
+}
+
+// numeroPaquet lit le numéro d'un datagramme chiffré
+func numeroPaquet(paquet []byte) uint64 {
+	return binary.BigEndian.Uint64(paquet[:8])
+}
+
+// nettoyerVus oublie les nonces de handshake plus vieux que duree à la date maintenant
+func nettoyerVus(vus map[string]time.Time, duree time.Duration, maintenant time.Time) {
+	for nonce, date := range vus {
+		if maintenant.Sub(date) > duree {
+			delete(vus, nonce)
+		}
+	}
+}